@@ -1,17 +1,29 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"expvar"
 	"fmt"
+	"html/template"
 	"io"
 	"io/ioutil"
+	stdlog "log"
+	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -19,51 +31,140 @@ import (
 	"net/url"
 	"os"
 	"os/user"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	texttemplate "text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/Jeffail/gabs"
 	"github.com/andrewseidl/viper"
+	"github.com/google/uuid"
 	"github.com/gorilla/handlers"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	metrics "github.com/rcrowley/go-metrics"
 	"github.com/rs/cors"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
+	"golang.org/x/net/http2"
+	"golang.org/x/sys/unix"
 	graceful "gopkg.in/tylerb/graceful.v1"
 )
 
 var (
 	port                int
 	httpsRedirectPort   int
+	debugPort           int
+	debugHost           string
 	backendURL          *url.URL
+	fallbackBackendURL  *url.URL
+	grpcProxy           *httputil.ReverseProxy
 	frontend            string
+	frontendFS          http.FileSystem
 	serversJSON         string
 	dataDir             string
 	tmpDir              string
 	certFile            string
 	peerCertFile        string
+	peerCertReload      time.Duration
 	keyFile             string
 	docsDir             string
-	readOnly            bool
+	readOnly            int32
 	verbose             bool
 	enableHTTPS         bool
 	enableHTTPSAuth     bool
 	enableHTTPSRedirect bool
+	httpsClientAuth     tls.ClientAuthType
 	profile             bool
 	compress            bool
 	enableMetrics       bool
+	metricsTailBytes    int
+	samlPlaceholders    map[string]bool
+	metricsDumpInterval time.Duration
+	metricsDumpFile     string
+	metricsDumpMaxSize  int64
+	metricsDumpKeep     int
+	requestTimingsSize  int
+	proxyAll            bool
+	frontendRequired    bool
+	allowNocacheParam   bool
+	serversJSONMaxParam int
+	serversJSONMaxForm  int64
+	disableServersJSON  bool
+	serversJSONSetPath  string
+	serversJSONOnRoot   bool
+	otelEndpoint        string
+	uploadContinue      bool
 	connTimeout         time.Duration
+	uploadTimeout       time.Duration
+	uploadTTL           time.Duration
+	uploadWebhook       string
+	maxUploadFiles      int
+	allowedUploadTypes  []string
+	statusPage          bool
+	checkDiskWritable   bool
+	endpointPolicies    []*endpointPolicy
+	docsCacheTTL        time.Duration
+	pingCacheTTL        time.Duration
+	samlConnectRetries  int
+	corsMaxAge          int
+	corsAllowedMethods  []string
 	version             string
 	proxies             []reverseProxy
+	staticMounts        []staticMount
+	trustedProxies      []*net.IPNet
+	adminAllowedCIDRs   []*net.IPNet
+	adminMinTLSVersion  uint16
+	logStripParams      map[string]bool
+	logStripQuery       []string
+	accessLogFormat     string
+	backendTransport    *http.Transport
+	proxyBuffers        *bufferPool
+	emitBackendHeader   bool
+	clientCertHeader    string
+	headerLogThreshold  int
+	headerLogNames      bool
+	uploadSessionHeader string
+	serverHeader        string
+	bannerHTML          atomic.Value
+	bannerEnabled       int32
+	allowedHosts        map[string]bool
+	blockedUserAgents   []*regexp.Regexp
+	maintenanceMode     int32
+	maintenanceFile     string
+	betaCookieMaxAge    time.Duration
+	betaRequireCookie   bool
+	backendHealthMethod string
+	backendHealthPath   string
+	healthCheckInterval time.Duration
+	healthCheckTimeout  time.Duration
+	preShutdownDelay    time.Duration
+	unreadyStatus       int
+	unreadyBody         *texttemplate.Template
+	tcpKeepAlive        time.Duration
+	reusePort           bool
+	draining            int32
+	warmupConnections   int
+	waitForBackend      time.Duration
+	slowQueryBudgets    map[string]time.Duration
+	slowQueryMaxBuffer  int
+	perDatabaseMetrics  bool
+	warmingUp           int32
 )
 
 var (
 	registry          metrics.Registry
 	sessionStore      *sessions.CookieStore
+	samlFlagKey       []byte
 	serversJSONParams []string
 )
 
@@ -86,6 +187,141 @@ type thriftMethodTimings struct {
 type reverseProxy struct {
 	Path   string
 	Target *url.URL
+	CORS   *cors.Cors
+}
+
+// proxyCORS overrides the CORS options for one reverse proxy route, from the
+// config file's [[web.reverse-proxy-cors]] tables. Unset options inherit the
+// global ones.
+type proxyCORS struct {
+	Path             string   `mapstructure:"path"`
+	AllowedOrigins   []string `mapstructure:"allowed-origins"`
+	AllowedHeaders   []string `mapstructure:"allowed-headers"`
+	AllowedMethods   []string `mapstructure:"allowed-methods"`
+	AllowCredentials bool     `mapstructure:"allow-credentials"`
+	MaxAge           int      `mapstructure:"max-age"`
+}
+
+var corsAllowedHeaders = []string{"Accept", "Cache-Control", "Content-Type", "sessionid", "X-Requested-With"}
+
+func (pc proxyCORS) handler() *cors.Cors {
+	opts := cors.Options{
+		AllowedOrigins:   pc.AllowedOrigins,
+		AllowedHeaders:   corsAllowedHeaders,
+		AllowedMethods:   corsAllowedMethods,
+		AllowCredentials: pc.AllowCredentials,
+		MaxAge:           corsMaxAge,
+	}
+	if len(pc.AllowedHeaders) > 0 {
+		opts.AllowedHeaders = pc.AllowedHeaders
+	}
+	if len(pc.AllowedMethods) > 0 {
+		opts.AllowedMethods = pc.AllowedMethods
+	}
+	if pc.MaxAge != 0 {
+		opts.MaxAge = pc.MaxAge
+	}
+	return cors.New(opts)
+}
+
+// serversJSONRule serves a different servers.json to clients within one of
+// ClientCIDRs or presenting a certificate with one of CertCNs, from the config
+// file's [[web.servers-json-rule]] tables. When both are given a client must
+// match both.
+type serversJSONRule struct {
+	ClientCIDRs []string `mapstructure:"client-cidrs"`
+	CertCNs     []string `mapstructure:"cert-cn"`
+	File        string   `mapstructure:"file"`
+
+	nets []*net.IPNet
+}
+
+var serversJSONRules []serversJSONRule
+
+// matches reports whether the rule applies to r.
+func (sr serversJSONRule) matches(r *http.Request) bool {
+	if len(sr.nets) > 0 {
+		if ip := clientIP(r); ip == nil || !containsIP(sr.nets, ip) {
+			return false
+		}
+	}
+	if len(sr.CertCNs) > 0 {
+		cert := clientCert(r)
+		if cert == nil {
+			return false
+		}
+		found := false
+		for _, cn := range sr.CertCNs {
+			if cn == cert.Subject.CommonName {
+				found = true
+			}
+		}
+		return found
+	}
+	return true
+}
+
+// listenerConfig is an address the server listens on and the set of handlers
+// it serves there: "public" for the frontend and backend, "admin" for metrics
+// and other administrative endpoints, or "redirect" to send HTTP clients to
+// HTTPS. Listeners come from the config file's [[web.listener]] tables, or
+// otherwise from --port, --debug-port and --enable-https-redirect.
+type listenerConfig struct {
+	Address string `mapstructure:"address"`
+	Handler string `mapstructure:"handler"`
+	TLS     bool   `mapstructure:"tls"`
+}
+
+var (
+	listeners     []listenerConfig
+	separateAdmin bool
+)
+
+// endpointPolicy limits the requests under a path prefix, which matches whole
+// path segments only. Zero values leave the corresponding limit off. Timeout
+// bounds the request context and the connection deadlines; it doesn't stop a
+// handler that ignores its context.
+type endpointPolicy struct {
+	Prefix         string        `mapstructure:"prefix"`
+	MaxConcurrency int           `mapstructure:"max-concurrency"`
+	Timeout        time.Duration `mapstructure:"timeout"`
+	MaxBodySize    int64         `mapstructure:"max-body-size"`
+
+	slots chan struct{}
+}
+
+// defaultEndpointPolicies are in effect unless the config file's
+// [[web.endpoint-policy]] tables override them by prefix. Their limits are
+// loose enough for large deployments, and only keep a flood of one kind of
+// request from starving the others.
+var defaultEndpointPolicies = []endpointPolicy{
+	// Thrift calls, which the backend bounds with its own timeouts
+	{Prefix: "/", MaxConcurrency: 1024},
+	// Each upload holds a temporary file open until it is stored
+	{Prefix: "/upload", MaxConcurrency: 64},
+	{Prefix: "/upload/resumable", MaxConcurrency: 64},
+	{Prefix: "/metrics/", MaxConcurrency: 4, Timeout: 10 * time.Second, MaxBodySize: 1 << 10},
+}
+
+// matches reports whether path is under the policy's prefix. "/upload" covers
+// "/upload" and "/upload/resumable" but not "/uploads". "/" only covers the
+// root, where Thrift calls are posted, rather than every path.
+func (ep *endpointPolicy) matches(path string) bool {
+	if ep.Prefix == "/" {
+		return path == "/"
+	}
+	if strings.HasSuffix(ep.Prefix, "/") {
+		return strings.HasPrefix(path, ep.Prefix)
+	}
+	return path == ep.Prefix || strings.HasPrefix(path, ep.Prefix+"/")
+}
+
+// staticMount serves the files of Dir under the URL prefix Path. With SPA set,
+// unknown paths get Dir's index.html.
+type staticMount struct {
+	Path string
+	Dir  string
+	SPA  bool
 }
 
 var (
@@ -97,10 +333,17 @@ const (
 	thriftSessionCookieName = "omnisci_session"
 	// The name of the JavaScript visible cookie indicating SAML auth has succeeded
 	samlAuthCookieName = "omnisci_saml_authorized"
+	// The name of the cookie holding the server's signature of the SAML session,
+	// without which samlAuthCookieName is not honored
+	samlSignatureCookieName = "omnisci_saml_signature"
 	// The magic value used as the "fake" session ID when Immerse is operating in SAML mode
 	samlPlaceholderSessionID = "8f61e7d0-b515-49d9-ad77-37ed6e2868ea"
 	// The page to redirect the user to when there are errors with SAML auth
 	samlErrorPage = "/saml-error.html"
+	// The name of the cookie granting access to the beta frontend under /beta/
+	betaCookieName = "omnisci-beta"
+	// The largest cookie, name and value, that browsers are guaranteed to keep
+	maxCookieSize = 4096
 )
 
 func getLogName(lvl string) string {
@@ -114,18 +357,98 @@ func getLogName(lvl string) string {
 	return n + "." + h + "." + u + ".log." + lvl + "." + t + "." + p
 }
 
+// readGzipConfig reads a gzip compressed config file, such as config.toml.gz,
+// whose format is given by the extension before .gz.
+func readGzipConfig(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return errors.New("could not decompress " + path + ": " + err.Error())
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return errors.New("could not decompress " + path + ": " + err.Error())
+	}
+	if ext := filepath.Ext(strings.TrimSuffix(path, ".gz")); ext != "" {
+		viper.SetConfigType(ext[1:])
+	}
+	return viper.ReadConfig(bytes.NewReader(data))
+}
+
 func init() {
 	var err error
 	pflag.IntP("port", "p", 6273, "frontend server port")
 	pflag.IntP("http-to-https-redirect-port", "", 6280, "frontend server port for http redirect, when https enabled")
+	pflag.IntP("debug-port", "", 0, "separate port serving metrics and profiling endpoints, 0 to serve them on the main port")
+	pflag.StringP("debug-host", "", "localhost", "address the debug port listens on")
 	pflag.StringP("backend-url", "b", "", "url to http-port on omnisci_server [http://localhost:6278]")
-	pflag.StringSliceP("reverse-proxy", "", nil, "additional endpoints to act as reverse proxies, format '/endpoint/:http://target.example.com'")
+	pflag.String("grpc-backend-url", "", "url of a gRPC endpoint that gRPC-Web calls are proxied to, over HTTP/2; gRPC-Web is refused if empty")
+	pflag.String("fallback-backend-url", "", "url of a standby omnisci_server used while health checks report the backend down")
+	pflag.StringSliceP("mime-overrides", "", []string{".wasm=application/wasm", ".mjs=text/javascript"}, "content types for served file extensions, format '.ext=type/subtype'")
+	pflag.StringSliceP("static-mounts", "", nil, "additional directories of static files to serve, format '/prefix/=/path/to/dir'")
+	pflag.StringSliceP("static-mounts-spa", "", nil, "prefixes of --static-mounts that serve their index.html for unknown paths")
+	pflag.StringSliceP("reverse-proxy", "", nil, "additional endpoints to act as reverse proxies, format '/endpoint/=http://target.example.com' (the older '/endpoint/:http://...' form is still accepted)")
 	pflag.StringP("frontend", "f", "frontend", "path to frontend directory")
+	pflag.Bool("status-page", false, "serve a built-in status page at / instead of the frontend, as is done when the frontend index.html is missing")
+	pflag.Bool("frontend-required", false, "refuse to start if the frontend index.html is missing, instead of only warning")
+	pflag.StringSliceP("frontend-overlay", "", nil, "directories searched in order for frontend files before the frontend directory")
+	pflag.Bool("proxy-all", false, "proxy all requests, including GETs, to omnisci_server instead of serving the frontend directory")
 	pflag.StringP("servers-json", "", "", "path to servers.json")
 	pflag.StringP("data", "d", "data", "path to OmniSci data directory")
 	pflag.StringP("tmpdir", "", "", "path for temporary file storage [/tmp]")
 	pflag.StringP("config", "c", "", "path to OmniSci configuration file")
 	pflag.StringP("docs", "", "docs", "path to documentation directory")
+	pflag.DurationP("docs-cache-ttl", "", 0, "max-age to advertise in Cache-Control for documentation files, 0 to omit")
+	pflag.StringSliceP("trusted-proxies", "", nil, "CIDRs of proxies trusted to set X-Forwarded-For")
+	pflag.StringSliceP("admin-allowed-cidrs", "", nil, "CIDRs allowed to reach administrative endpoints (metrics, profiling), empty to allow all")
+	pflag.StringP("admin-min-tls-version", "", "", "minimum TLS version (1.2, 1.3) of connections to administrative endpoints, which are then refused over plain HTTP; empty for no minimum")
+	pflag.StringSliceP("log-strip-query", "", nil, "path prefixes, such as static assets, whose query strings are left out of the access log")
+	pflag.StringP("access-log-format", "", "common", "access log format: common, or combined to add the referer and user agent")
+	pflag.StringSliceP("access-log-strip-query-params", "", []string{"password", "passwd", "token", "sessionid"}, "query parameters whose values are redacted from the access log")
+	pflag.Bool("backend-disable-keepalive", false, "disable keep-alive connections to omnisci_server")
+	pflag.DurationP("backend-idle-timeout", "", 90*time.Second, "how long idle keep-alive connections to omnisci_server are kept open")
+	pflag.DurationP("wait-for-backend", "", 0, "how long to wait at startup for omnisci_server to respond before listening anyway, 0 to listen right away")
+	pflag.IntP("backend-warmup-connections", "", 0, "connections to omnisci_server opened and pooled at startup, before /ready reports ready, 0 to disable")
+	pflag.StringP("backend-health-method", "", "tcp", "how /ready probes omnisci_server: tcp, thrift, or an HTTP method (GET, HEAD) requesting --backend-health-path")
+	pflag.StringP("backend-health-path", "", "/", "path requested on omnisci_server by HTTP health probes, which must return 200")
+	pflag.Bool("check-disk-writable", false, "periodically check that the data and temporary directories are writable, and report not ready when they are not")
+	pflag.DurationP("health-check-interval", "", 10*time.Second, "how often the backend, reverse proxy and disk targets are probed")
+	pflag.DurationP("health-check-timeout", "", 5*time.Second, "how long each health probe may take before its target is considered down")
+	pflag.StringP("otel-endpoint", "", "", "OTLP/HTTP collector to send request traces to, e.g. http://localhost:4318; tracing is off if empty")
+	pflag.Int("log-header-size-threshold", 0, "log the header sizes of proxied requests and responses whose headers exceed this many bytes, 0 to disable")
+	pflag.Bool("log-header-names", false, "include the names and sizes, but not values, of the headers in header size logs")
+	pflag.String("request-id-header", "X-Request-ID", "header carrying request IDs, taken from requests and echoed in responses")
+	pflag.String("client-cert-header", "", "header carrying the verified client certificate subject to the backend (requires enable-https-authentication)")
+	pflag.Bool("emit-backend-header", false, "add an X-OmniSci-Backend header naming the backend that served each proxied response")
+	pflag.IntP("proxy-buffer-size", "", 32<<10, "size in bytes of the pooled buffers used to copy proxied responses")
+	pflag.StringP("upload-required-header", "", "", "header, as 'Name: value', that uploads must carry, e.g. a secret shared with internal tools")
+	pflag.StringP("upload-trusted-session-header", "", "", "header holding a verified session ID for uploads, honored only from trusted proxies")
+	pflag.IntP("saml-connect-retries", "", 3, "number of times to retry the SAML connect call when omnisci_server is unavailable")
+	pflag.IntP("cors-max-age", "", 0, "seconds that browsers may cache CORS preflight results")
+	pflag.StringSliceP("cors-allowed-methods", "", []string{"GET", "HEAD", "POST", "DELETE"}, "methods allowed for cross-origin requests")
+	pflag.StringP("banner-html", "", "", "HTML snippet, such as a maintenance notice, inserted into the frontend's index.html; switched on and off at /admin/banner")
+	pflag.StringP("server-header", "", "", "value of the Server response header, including on proxied responses; empty to remove it")
+	pflag.StringSliceP("blocked-user-agents", "", nil, "regular expressions matching User-Agent headers to refuse with 403")
+	pflag.StringSliceP("allowed-hosts", "", nil, "host names, optionally with port, accepted in the Host header; empty to accept any")
+	pflag.Bool("beta-require-cookie", true, "only serve the beta frontend under /beta/ to users who opted in with the beta cookie")
+	pflag.DurationP("beta-cookie-max-age", "", 30*24*time.Hour, "how long an opt-in to the beta frontend lasts")
+	pflag.StringP("servers-json-set-path", "", "/_internal/set-servers-json", "path accepting servers.json overrides")
+	pflag.Bool("servers-json-root-overrides", false, "also accept servers.json overrides as form values on /, redirecting back to /; can capture Thrift calls")
+	pflag.Bool("disable-servers-endpoint", false, "do not serve servers.json or accept overrides for it")
+	pflag.DurationP("session-max-age", "", 0, "lifetime of the servers.json session cookie, 0 to keep it until the browser closes")
+	pflag.DurationP("servers-json-session-max-age", "", 0, "alias for --session-max-age, which it overrides when set")
+	pflag.String("saml-flag-key", "", "HMAC key, raw or hex encoded, signing the SAML authorization cookie; random if empty")
+	pflag.StringP("session-encryption-key", "", "", "AES key, 16, 24 or 32 bytes or hex encoded, encrypting the servers.json session cookie; random if empty")
+	pflag.Int64("servers-json-max-form-bytes", 64<<10, "largest form body posted to / that is checked for servers.json overrides")
+	pflag.Int("servers-json-max-param-length", 256, "maximum length of the username, password and database overrides for servers.json")
+	pflag.Bool("allow-nocache-param", false, "let a nocache query parameter force Cache-Control: no-store on frontend responses, for debugging")
+	pflag.Bool("maintenance-mode", false, "start in maintenance mode, answering requests with the maintenance page")
+	pflag.StringP("static-maintenance-file", "", "", "absolute path of the page served while in maintenance mode")
+	pflag.StringP("env-prefix", "", "", "prefix for configuration environment variables [MAPD]")
 
 	pflag.BoolP("read-only", "r", false, "enable read-only mode")
 	pflag.BoolP("quiet", "q", true, "suppress non-error messages")
@@ -133,13 +456,38 @@ func init() {
 	pflag.BoolP("enable-https", "", false, "enable HTTPS support")
 	pflag.BoolP("enable-https-authentication", "", false, "enable PKI authentication")
 	pflag.BoolP("enable-https-redirect", "", false, "enable HTTP to HTTPS redirect")
+	pflag.StringP("https-client-auth-mode", "", "require-and-verify", "client certificate policy for PKI authentication: none, request, require-any, verify-if-given, require-and-verify")
 	pflag.StringP("cert", "", "cert.pem", "certificate file for HTTPS")
-	pflag.StringP("peer-cert", "", "peercert.pem", "peer CA certificate PKI authentication")
+	pflag.StringP("peer-cert", "", "peercert.pem", "comma separated list of peer CA certificate files or directories for PKI authentication")
 	pflag.StringP("key", "", "key.pem", "key file for HTTPS")
+	pflag.DurationP("peer-cert-reload-interval", "", time.Minute, "how often to check the peer CA certificates for changes, 0 to disable")
 	pflag.DurationP("timeout", "", 60*time.Minute, "maximum request duration")
+	pflag.StringSliceP("allowed-upload-content-types", "", nil, "content types, as sniffed from the data, allowed for uploads, such as text/plain or text/*; empty to allow all")
+	pflag.Int("max-upload-files", 100, "maximum number of files in a single upload request")
+	pflag.StringP("upload-webhook", "", "", "URL notified with a JSON POST after each successful upload")
+	pflag.DurationP("upload-ttl", "", 0, "remove upload directories untouched for this long, 0 to keep them")
+	pflag.DurationP("tcp-keepalive", "", 0, "TCP keep-alive period of accepted connections, 0 for the system default, negative to disable")
+	pflag.Bool("reuse-port", false, "bind with SO_REUSEPORT, so a new server can take over the port before the old one exits")
+	pflag.Int("readyz-unready-status", http.StatusServiceUnavailable, "HTTP status of /ready and /readyz when not ready")
+	pflag.String("readyz-unready-body", "", "Go template of the JSON body of /ready and /readyz when not ready, with .Target, .Error and .Checked; {{json .Error}} quotes a value")
+	pflag.DurationP("pre-shutdown-delay", "", 0, "on SIGTERM, how long to fail /ready before closing the listener, so load balancers can drain the server")
+	pflag.DurationP("upload-timeout", "", 0, "maximum duration of an upload, defaults to --timeout")
+	pflag.DurationP("ping-cache-ttl", "", 1*time.Second, "duration to cache the result of the /ping backend check")
 	pflag.Bool("profile", false, "enable profiling, accessible from /debug/pprof")
 	pflag.Bool("compress", false, "enable gzip compression")
+	pflag.Bool("upload-expect-continue", true, "honor 'Expect: 100-continue' on uploads; when disabled such uploads are refused with 417")
 	pflag.Bool("metrics", false, "enable Thrift call metrics, accessible from /metrics")
+	pflag.Int("saml-session-scan-bytes", 4<<10, "bytes at the start of each Thrift call searched for the SAML placeholder session ID")
+	pflag.StringSliceP("saml-placeholder-session-ids", "", []string{samlPlaceholderSessionID}, "placeholder session IDs sent by the frontend in SAML mode and swapped for the real session")
+	pflag.Int("metrics-tail-bytes", 64<<10, "bytes at the end of each Thrift response retained to extract backend timings")
+	pflag.StringSliceP("slow-query-budgets", "", nil, "method=duration budgets, e.g. sql_execute=10s; responses whose backend reported total time exceeds them get X-OmniSci-Slow-Query")
+	pflag.IntP("slow-query-max-buffer", "", 8<<20, "largest response in bytes held back to check it against its slow query budget")
+	pflag.Bool("per-database-metrics", false, "also record Thrift call timings per database, as db.<database>.<method>, for sessions connected through this server")
+	pflag.Int("metrics-request-timings", 256, "number of recent per-request Thrift timings kept for /metrics/requests/")
+	pflag.DurationP("metrics-dump-interval", "", 0, "how often a JSON snapshot of the metrics is appended to --metrics-dump-file, 0 to disable")
+	pflag.StringP("metrics-dump-file", "", "", "file metrics snapshots are appended to, one per line [$DATA/mapd_log/omnisci_web_server.metrics.json]")
+	pflag.Int64P("metrics-dump-max-size", "", 10<<20, "size in bytes beyond which the metrics dump file is rotated")
+	pflag.IntP("metrics-dump-keep", "", 5, "number of rotated metrics dump files kept")
 	pflag.Bool("version", false, "return version")
 	pflag.CommandLine.MarkHidden("compress")
 	pflag.CommandLine.MarkHidden("profile")
@@ -151,21 +499,103 @@ func init() {
 
 	viper.BindPFlag("web.port", pflag.CommandLine.Lookup("port"))
 	viper.BindPFlag("web.http-to-https-redirect-port", pflag.CommandLine.Lookup("http-to-https-redirect-port"))
+	viper.BindPFlag("web.debug-port", pflag.CommandLine.Lookup("debug-port"))
+	viper.BindPFlag("web.debug-host", pflag.CommandLine.Lookup("debug-host"))
 	viper.BindPFlag("web.backend-url", pflag.CommandLine.Lookup("backend-url"))
+	viper.BindPFlag("web.fallback-backend-url", pflag.CommandLine.Lookup("fallback-backend-url"))
+	viper.BindPFlag("web.grpc-backend-url", pflag.CommandLine.Lookup("grpc-backend-url"))
+	viper.BindPFlag("web.backend-disable-keepalive", pflag.CommandLine.Lookup("backend-disable-keepalive"))
+	viper.BindPFlag("web.backend-idle-timeout", pflag.CommandLine.Lookup("backend-idle-timeout"))
+	viper.BindPFlag("web.backend-warmup-connections", pflag.CommandLine.Lookup("backend-warmup-connections"))
+	viper.BindPFlag("web.wait-for-backend", pflag.CommandLine.Lookup("wait-for-backend"))
+	viper.BindPFlag("web.proxy-buffer-size", pflag.CommandLine.Lookup("proxy-buffer-size"))
+	viper.BindPFlag("web.backend-health-method", pflag.CommandLine.Lookup("backend-health-method"))
+	viper.BindPFlag("web.backend-health-path", pflag.CommandLine.Lookup("backend-health-path"))
+	viper.BindPFlag("web.check-disk-writable", pflag.CommandLine.Lookup("check-disk-writable"))
+	viper.BindPFlag("web.health-check-interval", pflag.CommandLine.Lookup("health-check-interval"))
+	viper.BindPFlag("web.health-check-timeout", pflag.CommandLine.Lookup("health-check-timeout"))
+	viper.BindPFlag("web.otel-endpoint", pflag.CommandLine.Lookup("otel-endpoint"))
+	viper.BindPFlag("web.log-header-size-threshold", pflag.CommandLine.Lookup("log-header-size-threshold"))
+	viper.BindPFlag("web.log-header-names", pflag.CommandLine.Lookup("log-header-names"))
+	viper.BindPFlag("web.request-id-header", pflag.CommandLine.Lookup("request-id-header"))
+	viper.BindPFlag("web.client-cert-header", pflag.CommandLine.Lookup("client-cert-header"))
+	viper.BindPFlag("web.emit-backend-header", pflag.CommandLine.Lookup("emit-backend-header"))
 	viper.BindPFlag("web.reverse-proxy", pflag.CommandLine.Lookup("reverse-proxy"))
+	viper.BindPFlag("web.mime-overrides", pflag.CommandLine.Lookup("mime-overrides"))
+	viper.BindPFlag("web.static-mounts", pflag.CommandLine.Lookup("static-mounts"))
+	viper.BindPFlag("web.static-mounts-spa", pflag.CommandLine.Lookup("static-mounts-spa"))
 	viper.BindPFlag("web.frontend", pflag.CommandLine.Lookup("frontend"))
+	viper.BindPFlag("web.status-page", pflag.CommandLine.Lookup("status-page"))
+	viper.BindPFlag("web.frontend-required", pflag.CommandLine.Lookup("frontend-required"))
+	viper.BindPFlag("web.frontend-overlay", pflag.CommandLine.Lookup("frontend-overlay"))
+	viper.BindPFlag("web.proxy-all", pflag.CommandLine.Lookup("proxy-all"))
 	viper.BindPFlag("web.servers-json", pflag.CommandLine.Lookup("servers-json"))
 	viper.BindPFlag("web.enable-https", pflag.CommandLine.Lookup("enable-https"))
 	viper.BindPFlag("web.enable-https-authentication", pflag.CommandLine.Lookup("enable-https-authentication"))
 	viper.BindPFlag("web.enable-https-redirect", pflag.CommandLine.Lookup("enable-https-redirect"))
+	viper.BindPFlag("web.https-client-auth-mode", pflag.CommandLine.Lookup("https-client-auth-mode"))
 	viper.BindPFlag("web.cert", pflag.CommandLine.Lookup("cert"))
 	viper.BindPFlag("web.peer-cert", pflag.CommandLine.Lookup("peer-cert"))
 	viper.BindPFlag("web.key", pflag.CommandLine.Lookup("key"))
+	viper.BindPFlag("web.peer-cert-reload-interval", pflag.CommandLine.Lookup("peer-cert-reload-interval"))
 	viper.BindPFlag("web.timeout", pflag.CommandLine.Lookup("timeout"))
+	viper.BindPFlag("web.upload-timeout", pflag.CommandLine.Lookup("upload-timeout"))
+	viper.BindPFlag("web.allowed-upload-content-types", pflag.CommandLine.Lookup("allowed-upload-content-types"))
+	viper.BindPFlag("web.max-upload-files", pflag.CommandLine.Lookup("max-upload-files"))
+	viper.BindPFlag("web.upload-webhook", pflag.CommandLine.Lookup("upload-webhook"))
+	viper.BindPFlag("web.upload-ttl", pflag.CommandLine.Lookup("upload-ttl"))
+	viper.BindPFlag("web.tcp-keepalive", pflag.CommandLine.Lookup("tcp-keepalive"))
+	viper.BindPFlag("web.reuse-port", pflag.CommandLine.Lookup("reuse-port"))
+	viper.BindPFlag("web.readyz-unready-status", pflag.CommandLine.Lookup("readyz-unready-status"))
+	viper.BindPFlag("web.readyz-unready-body", pflag.CommandLine.Lookup("readyz-unready-body"))
+	viper.BindPFlag("web.pre-shutdown-delay", pflag.CommandLine.Lookup("pre-shutdown-delay"))
+	viper.BindPFlag("web.ping-cache-ttl", pflag.CommandLine.Lookup("ping-cache-ttl"))
 	viper.BindPFlag("web.profile", pflag.CommandLine.Lookup("profile"))
 	viper.BindPFlag("web.compress", pflag.CommandLine.Lookup("compress"))
+	viper.BindPFlag("web.upload-expect-continue", pflag.CommandLine.Lookup("upload-expect-continue"))
 	viper.BindPFlag("web.metrics", pflag.CommandLine.Lookup("metrics"))
+	viper.BindPFlag("web.saml-session-scan-bytes", pflag.CommandLine.Lookup("saml-session-scan-bytes"))
+	viper.BindPFlag("web.saml-placeholder-session-ids", pflag.CommandLine.Lookup("saml-placeholder-session-ids"))
+	viper.BindPFlag("web.metrics-tail-bytes", pflag.CommandLine.Lookup("metrics-tail-bytes"))
+	viper.BindPFlag("web.per-database-metrics", pflag.CommandLine.Lookup("per-database-metrics"))
+	viper.BindPFlag("web.slow-query-budgets", pflag.CommandLine.Lookup("slow-query-budgets"))
+	viper.BindPFlag("web.slow-query-max-buffer", pflag.CommandLine.Lookup("slow-query-max-buffer"))
+	viper.BindPFlag("web.metrics-dump-interval", pflag.CommandLine.Lookup("metrics-dump-interval"))
+	viper.BindPFlag("web.metrics-dump-file", pflag.CommandLine.Lookup("metrics-dump-file"))
+	viper.BindPFlag("web.metrics-dump-max-size", pflag.CommandLine.Lookup("metrics-dump-max-size"))
+	viper.BindPFlag("web.metrics-dump-keep", pflag.CommandLine.Lookup("metrics-dump-keep"))
+	viper.BindPFlag("web.metrics-request-timings", pflag.CommandLine.Lookup("metrics-request-timings"))
 	viper.BindPFlag("web.docs", pflag.CommandLine.Lookup("docs"))
+	viper.BindPFlag("web.trusted-proxies", pflag.CommandLine.Lookup("trusted-proxies"))
+	viper.BindPFlag("web.admin-allowed-cidrs", pflag.CommandLine.Lookup("admin-allowed-cidrs"))
+	viper.BindPFlag("web.admin-min-tls-version", pflag.CommandLine.Lookup("admin-min-tls-version"))
+	viper.BindPFlag("web.log-strip-query", pflag.CommandLine.Lookup("log-strip-query"))
+	viper.BindPFlag("web.access-log-format", pflag.CommandLine.Lookup("access-log-format"))
+	viper.BindPFlag("web.access-log-strip-query-params", pflag.CommandLine.Lookup("access-log-strip-query-params"))
+	viper.BindPFlag("web.upload-required-header", pflag.CommandLine.Lookup("upload-required-header"))
+	viper.BindPFlag("web.upload-trusted-session-header", pflag.CommandLine.Lookup("upload-trusted-session-header"))
+	viper.BindPFlag("web.saml-connect-retries", pflag.CommandLine.Lookup("saml-connect-retries"))
+	viper.BindPFlag("web.cors-max-age", pflag.CommandLine.Lookup("cors-max-age"))
+	viper.BindPFlag("web.cors-allowed-methods", pflag.CommandLine.Lookup("cors-allowed-methods"))
+	viper.BindPFlag("web.server-header", pflag.CommandLine.Lookup("server-header"))
+	viper.BindPFlag("web.banner-html", pflag.CommandLine.Lookup("banner-html"))
+	viper.BindPFlag("web.blocked-user-agents", pflag.CommandLine.Lookup("blocked-user-agents"))
+	viper.BindPFlag("web.allowed-hosts", pflag.CommandLine.Lookup("allowed-hosts"))
+	viper.BindPFlag("web.beta-require-cookie", pflag.CommandLine.Lookup("beta-require-cookie"))
+	viper.BindPFlag("web.beta-cookie-max-age", pflag.CommandLine.Lookup("beta-cookie-max-age"))
+	viper.BindPFlag("web.servers-json-set-path", pflag.CommandLine.Lookup("servers-json-set-path"))
+	viper.BindPFlag("web.servers-json-root-overrides", pflag.CommandLine.Lookup("servers-json-root-overrides"))
+	viper.BindPFlag("web.disable-servers-endpoint", pflag.CommandLine.Lookup("disable-servers-endpoint"))
+	viper.BindPFlag("web.session-max-age", pflag.CommandLine.Lookup("session-max-age"))
+	viper.BindPFlag("web.servers-json-session-max-age", pflag.CommandLine.Lookup("servers-json-session-max-age"))
+	viper.BindPFlag("web.saml-flag-key", pflag.CommandLine.Lookup("saml-flag-key"))
+	viper.BindPFlag("web.session-encryption-key", pflag.CommandLine.Lookup("session-encryption-key"))
+	viper.BindPFlag("web.servers-json-max-form-bytes", pflag.CommandLine.Lookup("servers-json-max-form-bytes"))
+	viper.BindPFlag("web.servers-json-max-param-length", pflag.CommandLine.Lookup("servers-json-max-param-length"))
+	viper.BindPFlag("web.allow-nocache-param", pflag.CommandLine.Lookup("allow-nocache-param"))
+	viper.BindPFlag("web.maintenance-mode", pflag.CommandLine.Lookup("maintenance-mode"))
+	viper.BindPFlag("web.static-maintenance-file", pflag.CommandLine.Lookup("static-maintenance-file"))
+	viper.BindPFlag("web.docs-cache-ttl", pflag.CommandLine.Lookup("docs-cache-ttl"))
 
 	viper.BindPFlag("data", pflag.CommandLine.Lookup("data"))
 	viper.BindPFlag("tmpdir", pflag.CommandLine.Lookup("tmpdir"))
@@ -177,7 +607,17 @@ func init() {
 
 	viper.SetDefault("http-port", 6278)
 
-	viper.SetEnvPrefix("MAPD")
+	// The environment variable prefix is resolved before any other config is
+	// loaded, in order of precedence: the --env-prefix flag, the
+	// OMNISCI_ENV_PREFIX environment variable, and finally the default "MAPD".
+	envPrefix := "MAPD"
+	if p := os.Getenv("OMNISCI_ENV_PREFIX"); p != "" {
+		envPrefix = p
+	}
+	if p, _ := pflag.CommandLine.GetString("env-prefix"); p != "" {
+		envPrefix = p
+	}
+	viper.SetEnvPrefix(envPrefix)
 	r := strings.NewReplacer(".", "_")
 	viper.SetEnvKeyReplacer(r)
 	viper.AutomaticEnv()
@@ -192,8 +632,12 @@ func init() {
 		os.Exit(0)
 	}
 
-	if viper.IsSet("config") {
-		viper.SetConfigFile(viper.GetString("config"))
+	if cfg := viper.GetString("config"); viper.IsSet("config") && strings.HasSuffix(cfg, ".gz") {
+		if err := readGzipConfig(cfg); err != nil {
+			log.Warn("Error reading config file: " + err.Error())
+		}
+	} else if viper.IsSet("config") {
+		viper.SetConfigFile(cfg)
 		err := viper.ReadInConfig()
 		if err != nil {
 			log.Warn("Error reading config file: " + err.Error())
@@ -202,8 +646,20 @@ func init() {
 
 	port = viper.GetInt("web.port")
 	httpsRedirectPort = viper.GetInt("web.http-to-https-redirect-port")
+	debugPort = viper.GetInt("web.debug-port")
+	debugHost = viper.GetString("web.debug-host")
 	frontend = viper.GetString("web.frontend")
+	proxyAll = viper.GetBool("web.proxy-all")
+	frontendRequired = viper.GetBool("web.frontend-required")
+	statusPage = viper.GetBool("web.status-page")
+
+	var frontendDirs overlayFileSystem
+	for _, d := range viper.GetStringSlice("web.frontend-overlay") {
+		frontendDirs = append(frontendDirs, http.Dir(d))
+	}
+	frontendFS = append(frontendDirs, http.Dir(frontend))
 	docsDir = viper.GetString("web.docs")
+	docsCacheTTL = viper.GetDuration("web.docs-cache-ttl")
 	serversJSON = viper.GetString("web.servers-json")
 
 	if viper.IsSet("quiet") && !viper.IsSet("verbose") {
@@ -213,11 +669,132 @@ func init() {
 		verbose = viper.GetBool("verbose")
 	}
 	dataDir = viper.GetString("data")
-	readOnly = viper.GetBool("read-only")
+	if viper.GetBool("read-only") {
+		readOnly = 1
+	}
 	connTimeout = viper.GetDuration("web.timeout")
+	uploadTimeout = viper.GetDuration("web.upload-timeout")
+	if uploadTimeout == 0 {
+		uploadTimeout = connTimeout
+	}
+	preShutdownDelay = viper.GetDuration("web.pre-shutdown-delay")
+	unreadyStatus = viper.GetInt("web.readyz-unready-status")
+	if unreadyStatus < 200 || unreadyStatus > 599 {
+		log.Fatalln("Invalid unready status:", unreadyStatus)
+	}
+	if t := viper.GetString("web.readyz-unready-body"); t != "" {
+		unreadyBody, err = parseUnreadyBody(t)
+		if err != nil {
+			log.Fatalln("Invalid unready body template:", err)
+		}
+	}
+	tcpKeepAlive = viper.GetDuration("web.tcp-keepalive")
+	reusePort = viper.GetBool("web.reuse-port")
+	uploadTTL = viper.GetDuration("web.upload-ttl")
+	uploadWebhook = viper.GetString("web.upload-webhook")
+	maxUploadFiles = viper.GetInt("web.max-upload-files")
+	for _, t := range viper.GetStringSlice("web.allowed-upload-content-types") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			allowedUploadTypes = append(allowedUploadTypes, t)
+		}
+	}
+	if maxUploadFiles <= 0 {
+		log.Fatalln("Maximum number of upload files must be positive")
+	}
+	uploadSessionHeader = viper.GetString("web.upload-trusted-session-header")
+	if h := viper.GetString("web.upload-required-header"); h != "" {
+		kv := strings.SplitN(h, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			log.Fatalln("Upload required header must be given as 'Name: value'")
+		}
+		uploadRequiredHeader = http.CanonicalHeaderKey(strings.TrimSpace(kv[0]))
+		uploadRequiredValue = strings.TrimSpace(kv[1])
+	}
+	serverHeader = viper.GetString("web.server-header")
+	bannerHTML.Store(viper.GetString("web.banner-html"))
+	if bannerHTML.Load().(string) != "" {
+		bannerEnabled = 1
+	}
+	if viper.GetBool("web.maintenance-mode") {
+		maintenanceMode = 1
+	}
+	maintenanceFile = viper.GetString("web.static-maintenance-file")
+	allowNocacheParam = viper.GetBool("web.allow-nocache-param")
+	serversJSONMaxParam = viper.GetInt("web.servers-json-max-param-length")
+	serversJSONMaxForm = viper.GetInt64("web.servers-json-max-form-bytes")
+	disableServersJSON = viper.GetBool("web.disable-servers-endpoint")
+	serversJSONSetPath = viper.GetString("web.servers-json-set-path")
+	if !strings.HasPrefix(serversJSONSetPath, "/") {
+		log.Fatalln("Invalid servers.json set path:", serversJSONSetPath)
+	}
+	serversJSONOnRoot = viper.GetBool("web.servers-json-root-overrides")
+	betaCookieMaxAge = viper.GetDuration("web.beta-cookie-max-age")
+	betaRequireCookie = viper.GetBool("web.beta-require-cookie")
+	if maintenanceFile != "" && !filepath.IsAbs(maintenanceFile) {
+		log.Fatalln("Maintenance file must be an absolute path:", maintenanceFile)
+	}
+	for _, ua := range viper.GetStringSlice("web.blocked-user-agents") {
+		re, err := regexp.Compile(strings.TrimSpace(ua))
+		if err != nil {
+			log.Fatalln("Invalid blocked User-Agent pattern:", err)
+		}
+		blockedUserAgents = append(blockedUserAgents, re)
+	}
+
+	allowedHosts = make(map[string]bool)
+	for _, h := range viper.GetStringSlice("web.allowed-hosts") {
+		allowedHosts[strings.ToLower(strings.TrimSpace(h))] = true
+	}
+	pingCacheTTL = viper.GetDuration("web.ping-cache-ttl")
+	samlConnectRetries = viper.GetInt("web.saml-connect-retries")
+	corsMaxAge = viper.GetInt("web.cors-max-age")
+	corsAllowedMethods = viper.GetStringSlice("web.cors-allowed-methods")
 	profile = viper.GetBool("web.profile")
 	compress = viper.GetBool("web.compress")
 	enableMetrics = viper.GetBool("web.metrics")
+	samlSessionScanBytes = viper.GetInt("web.saml-session-scan-bytes")
+	if samlSessionScanBytes <= 0 {
+		log.Fatalln("Invalid SAML session scan size:", samlSessionScanBytes)
+	}
+	samlPlaceholders = make(map[string]bool)
+	for _, id := range viper.GetStringSlice("web.saml-placeholder-session-ids") {
+		if id = strings.TrimSpace(id); id != "" {
+			samlPlaceholders[id] = true
+		}
+	}
+	if len(samlPlaceholders) == 0 {
+		log.Fatalln("At least one SAML placeholder session ID is required")
+	}
+	metricsTailBytes = viper.GetInt("web.metrics-tail-bytes")
+	if metricsTailBytes <= 0 {
+		log.Fatalln("Invalid metrics tail size:", metricsTailBytes)
+	}
+	requestTimingsSize = viper.GetInt("web.metrics-request-timings")
+	slowQueryBudgets = make(map[string]time.Duration)
+	for _, b := range viper.GetStringSlice("web.slow-query-budgets") {
+		kv := strings.SplitN(b, "=", 2)
+		if len(kv) != 2 {
+			log.Fatalln("Invalid slow query budget, need method=duration:", b)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil || d <= 0 {
+			log.Fatalln("Invalid slow query budget:", b)
+		}
+		slowQueryBudgets[strings.TrimSpace(kv[0])] = d
+	}
+	slowQueryMaxBuffer = viper.GetInt("web.slow-query-max-buffer")
+	perDatabaseMetrics = viper.GetBool("web.per-database-metrics")
+	metricsDumpInterval = viper.GetDuration("web.metrics-dump-interval")
+	if metricsDumpInterval < 0 {
+		log.Fatalln("Invalid metrics dump interval:", metricsDumpInterval)
+	}
+	metricsDumpFile = viper.GetString("web.metrics-dump-file")
+	metricsDumpMaxSize = viper.GetInt64("web.metrics-dump-max-size")
+	metricsDumpKeep = viper.GetInt("web.metrics-dump-keep")
+	if metricsDumpMaxSize <= 0 || metricsDumpKeep < 0 {
+		log.Fatalln("Invalid metrics dump rotation:", metricsDumpMaxSize, "bytes,", metricsDumpKeep, "files")
+	}
+	uploadContinue = viper.GetBool("web.upload-expect-continue")
 
 	backendURLStr := viper.GetString("web.backend-url")
 	if backendURLStr == "" {
@@ -229,26 +806,229 @@ func init() {
 		log.Fatal(err)
 	}
 
+	if s := viper.GetString("web.fallback-backend-url"); s != "" {
+		fallbackBackendURL, err = url.Parse(s)
+		if err != nil || fallbackBackendURL.Scheme == "" || fallbackBackendURL.Host == "" {
+			log.Fatalln("Invalid fallback backend URL:", s)
+		}
+	}
+
+	if s := viper.GetString("web.grpc-backend-url"); s != "" {
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalln("Invalid gRPC backend URL:", s)
+		}
+		grpcProxy = newGRPCWebProxy(u)
+	}
+
+	// All connections to the backend share a single Transport, and therefore a
+	// single connection pool.
+	backendTransport = http.DefaultTransport.(*http.Transport).Clone()
+	backendTransport.DisableKeepAlives = viper.GetBool("web.backend-disable-keepalive")
+	backendTransport.IdleConnTimeout = viper.GetDuration("web.backend-idle-timeout")
+	waitForBackend = viper.GetDuration("web.wait-for-backend")
+	if waitForBackend < 0 {
+		log.Fatalln("Invalid backend wait:", waitForBackend)
+	}
+	warmupConnections = viper.GetInt("web.backend-warmup-connections")
+	if warmupConnections < 0 {
+		log.Fatalln("Invalid number of backend warmup connections:", warmupConnections)
+	}
+	if warmupConnections > 0 && backendTransport.DisableKeepAlives {
+		log.Warnln("Backend warmup has no effect with keep-alive disabled")
+		warmupConnections = 0
+	}
+	// Otherwise all but the default two idle connections would be closed again
+	if warmupConnections > http.DefaultMaxIdleConnsPerHost {
+		backendTransport.MaxIdleConnsPerHost = warmupConnections
+	}
+
+	if viper.GetInt("web.proxy-buffer-size") <= 0 {
+		log.Fatalln("Proxy buffer size must be positive")
+	}
+	proxyBuffers = newBufferPool(viper.GetInt("web.proxy-buffer-size"))
+	emitBackendHeader = viper.GetBool("web.emit-backend-header")
+	clientCertHeader = http.CanonicalHeaderKey(viper.GetString("web.client-cert-header"))
+	requestIDHeader = http.CanonicalHeaderKey(viper.GetString("web.request-id-header"))
+	if !regexp.MustCompile(`^[A-Za-z0-9-]+$`).MatchString(requestIDHeader) {
+		log.Fatalln("Invalid request ID header:", requestIDHeader)
+	}
+	headerLogThreshold = viper.GetInt("web.log-header-size-threshold")
+	headerLogNames = viper.GetBool("web.log-header-names")
+
+	if otelEndpoint = viper.GetString("web.otel-endpoint"); otelEndpoint != "" {
+		u, err := url.Parse(otelEndpoint)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			log.Fatalln("Invalid OpenTelemetry endpoint:", otelEndpoint)
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/traces"
+		}
+		otelEndpoint = u.String()
+		spanQueue = make(chan *traceSpan, 4096)
+		spanStop = make(chan struct{})
+		spanDone = make(chan struct{})
+	}
+
+	backendHealthMethod = strings.ToUpper(viper.GetString("web.backend-health-method"))
+	switch backendHealthMethod {
+	case "TCP", "THRIFT", "GET", "HEAD":
+	default:
+		log.Fatalln("Invalid backend health method:", viper.GetString("web.backend-health-method"))
+	}
+	backendHealthPath = viper.GetString("web.backend-health-path")
+	healthCheckInterval = viper.GetDuration("web.health-check-interval")
+	healthCheckTimeout = viper.GetDuration("web.health-check-timeout")
+	checkDiskWritable = viper.GetBool("web.check-disk-writable")
+	if healthCheckInterval <= 0 || healthCheckTimeout <= 0 {
+		log.Fatalln("Health check interval and timeout must be positive")
+	}
+
+	var configuredPolicies []endpointPolicy
+	if err := viper.UnmarshalKey("web.endpoint-policy", &configuredPolicies); err != nil {
+		log.Fatalln("Could not parse endpoint policies:", err)
+	}
+	for _, ep := range append(defaultEndpointPolicies, configuredPolicies...) {
+		if len(ep.Prefix) == 0 || ep.Prefix[0] != '/' {
+			log.Fatalln("Endpoint policy prefix must start with '/':", ep.Prefix)
+		}
+		if ep.MaxConcurrency < 0 || ep.Timeout < 0 || ep.MaxBodySize < 0 {
+			log.Fatalln("Endpoint policy limits must not be negative:", ep.Prefix)
+		}
+		ep := ep
+		if ep.MaxConcurrency > 0 {
+			ep.slots = make(chan struct{}, ep.MaxConcurrency)
+		}
+		replaced := false
+		for i := range endpointPolicies {
+			if endpointPolicies[i].Prefix == ep.Prefix {
+				endpointPolicies[i] = &ep
+				replaced = true
+			}
+		}
+		if !replaced {
+			endpointPolicies = append(endpointPolicies, &ep)
+		}
+	}
+	sort.SliceStable(endpointPolicies, func(i, j int) bool {
+		return len(endpointPolicies[i].Prefix) > len(endpointPolicies[j].Prefix)
+	})
+
 	for _, rp := range viper.GetStringSlice("web.reverse-proxy") {
-		s := strings.SplitN(rp, ":", 2)
-		if len(s) != 2 {
-			log.Fatalln("Could not parse reverse proxy string:", rp)
+		p, err := parseReverseProxy(rp)
+		if err != nil {
+			log.Fatalln(err)
 		}
-		path := s[0]
-		if len(path) == 0 {
-			log.Fatalln("Zero-length path passed for reverse proxy:", rp)
+		proxies = append(proxies, p)
+	}
+
+	if err := viper.UnmarshalKey("web.servers-json-rule", &serversJSONRules); err != nil {
+		log.Fatalln("Could not parse servers.json rules:", err)
+	}
+	for i := range serversJSONRules {
+		sr := &serversJSONRules[i]
+		if sr.File == "" {
+			log.Fatalln("servers.json rule without a file")
+		}
+		if len(sr.ClientCIDRs) == 0 && len(sr.CertCNs) == 0 {
+			log.Fatalln("servers.json rule matches no clients:", sr.File)
+		}
+		sr.nets, err = parseCIDRs(sr.ClientCIDRs)
+		if err != nil {
+			log.Fatalln("Could not parse servers.json rule CIDRs:", err)
+		}
+	}
+
+	var proxyCORSOptions []proxyCORS
+	if err := viper.UnmarshalKey("web.reverse-proxy-cors", &proxyCORSOptions); err != nil {
+		log.Fatalln("Could not parse reverse proxy CORS options:", err)
+	}
+	for _, pc := range proxyCORSOptions {
+		if len(pc.Path) > 0 && pc.Path[len(pc.Path)-1] != '/' {
+			pc.Path += "/"
+		}
+		found := false
+		for i := range proxies {
+			if proxies[i].Path == pc.Path {
+				proxies[i].CORS = pc.handler()
+				found = true
+			}
+		}
+		if !found {
+			log.Fatalln("CORS options given for unknown reverse proxy:", pc.Path)
 		}
+	}
+
+	spaMounts := make(map[string]bool)
+	for _, p := range viper.GetStringSlice("web.static-mounts-spa") {
+		if p = strings.TrimSpace(p); len(p) > 0 && p[len(p)-1] != '/' {
+			p += "/"
+		}
+		spaMounts[p] = true
+	}
+	for _, mo := range viper.GetStringSlice("web.mime-overrides") {
+		s := strings.SplitN(mo, "=", 2)
+		if len(s) != 2 || !strings.HasPrefix(s[0], ".") {
+			log.Fatalln("Could not parse MIME override string:", mo)
+		}
+		if err := mime.AddExtensionType(s[0], s[1]); err != nil {
+			log.Fatalln("Invalid MIME override", mo+":", err)
+		}
+	}
+
+	for _, sm := range viper.GetStringSlice("web.static-mounts") {
+		s := strings.SplitN(sm, "=", 2)
+		if len(s) != 2 || len(s[0]) == 0 || s[0][0] != '/' {
+			log.Fatalln("Could not parse static mount string:", sm)
+		}
+		path := s[0]
 		if path[len(path)-1] != '/' {
 			path += "/"
 		}
-		target, err := url.Parse(s[1])
-		if err != nil {
-			log.Fatal(err)
+		if fi, err := os.Stat(s[1]); err != nil || !fi.IsDir() {
+			log.Fatalln("Static mount directory does not exist:", s[1])
+		}
+		mount := staticMount{path, s[1], spaMounts[path]}
+		if mount.SPA {
+			if _, err := os.Stat(filepath.Join(mount.Dir, "index.html")); err != nil {
+				log.Fatalln("Static mount", path, "serves index.html for unknown paths, but it is missing:", err)
+			}
+		}
+		staticMounts = append(staticMounts, mount)
+	}
+	if err := checkPaths(); err != nil {
+		log.Fatalln(err)
+	}
+
+	trustedProxies, err = parseCIDRs(viper.GetStringSlice("web.trusted-proxies"))
+	if err != nil {
+		log.Fatalln("Could not parse trusted proxies:", err)
+	}
+	adminAllowedCIDRs, err = parseCIDRs(viper.GetStringSlice("web.admin-allowed-cidrs"))
+	if err != nil {
+		log.Fatalln("Could not parse admin allowed CIDRs:", err)
+	}
+	if v := viper.GetString("web.admin-min-tls-version"); v != "" {
+		tlsVersions := map[string]uint16{
+			"1.0": tls.VersionTLS10,
+			"1.1": tls.VersionTLS11,
+			"1.2": tls.VersionTLS12,
+			"1.3": tls.VersionTLS13,
 		}
-		if target.Scheme == "" {
-			log.Fatalln("Missing URL scheme, need full URL including http/https:", target)
+		var ok bool
+		if adminMinTLSVersion, ok = tlsVersions[v]; !ok {
+			log.Fatalln("Invalid admin minimum TLS version:", v)
 		}
-		proxies = append(proxies, reverseProxy{path, target})
+	}
+
+	logStripQuery = viper.GetStringSlice("web.log-strip-query")
+	accessLogFormat = strings.ToLower(viper.GetString("web.access-log-format"))
+	if accessLogFormat != "common" && accessLogFormat != "combined" {
+		log.Fatalln("Invalid access log format:", accessLogFormat)
+	}
+	logStripParams = make(map[string]bool)
+	for _, p := range viper.GetStringSlice("web.access-log-strip-query-params") {
+		logStripParams[strings.ToLower(strings.TrimSpace(p))] = true
 	}
 
 	if os.Getenv("TMPDIR") != "" {
@@ -268,9 +1048,56 @@ func init() {
 	enableHTTPS = viper.GetBool("web.enable-https")
 	enableHTTPSAuth = viper.GetBool("web.enable-https-authentication")
 	enableHTTPSRedirect = viper.GetBool("web.enable-https-redirect")
+	if err := viper.UnmarshalKey("web.listener", &listeners); err != nil {
+		log.Fatalln("Could not parse listeners:", err)
+	}
+	if len(listeners) > 0 {
+		if err := checkListeners(listeners); err != nil {
+			log.Fatalln(err)
+		}
+	} else if enableHTTPSRedirect {
+		// The redirect listener only runs alongside the HTTPS one
+		if !enableHTTPS {
+			log.Warnln("HTTP to HTTPS redirect is enabled but HTTPS is not, so no redirect listener is started")
+		} else if httpsRedirectPort <= 0 || httpsRedirectPort > 65535 {
+			log.Fatalln("Invalid HTTP to HTTPS redirect port:", httpsRedirectPort)
+		} else if httpsRedirectPort == port {
+			log.Fatalln("HTTP to HTTPS redirect port", httpsRedirectPort, "must differ from the server port")
+		} else if httpsRedirectPort == debugPort {
+			log.Fatalln("HTTP to HTTPS redirect port", httpsRedirectPort, "must differ from the debug port")
+		}
+	}
+	if len(listeners) == 0 {
+		listeners = append(listeners, listenerConfig{":" + strconv.Itoa(port), "public", enableHTTPS})
+		if debugPort != 0 {
+			listeners = append(listeners, listenerConfig{net.JoinHostPort(debugHost, strconv.Itoa(debugPort)), "admin", false})
+		}
+		if enableHTTPS && enableHTTPSRedirect {
+			listeners = append(listeners, listenerConfig{":" + strconv.Itoa(httpsRedirectPort), "redirect", false})
+		}
+	}
+	for _, lc := range listeners {
+		if lc.Handler == "admin" {
+			separateAdmin = true
+		}
+	}
 	certFile = viper.GetString("web.cert")
 	keyFile = viper.GetString("web.key")
 	peerCertFile = viper.GetString("web.peer-cert")
+	peerCertReload = viper.GetDuration("web.peer-cert-reload-interval")
+
+	clientAuthModes := map[string]tls.ClientAuthType{
+		"none":               tls.NoClientCert,
+		"request":            tls.RequestClientCert,
+		"require-any":        tls.RequireAnyClientCert,
+		"verify-if-given":    tls.VerifyClientCertIfGiven,
+		"require-and-verify": tls.RequireAndVerifyClientCert,
+	}
+	clientAuthMode := viper.GetString("web.https-client-auth-mode")
+	var ok bool
+	if httpsClientAuth, ok = clientAuthModes[clientAuthMode]; !ok {
+		log.Fatalln("Invalid HTTPS client auth mode:", clientAuthMode)
+	}
 
 	registry = metrics.NewRegistry()
 
@@ -293,494 +1120,4337 @@ func init() {
 	b := make([]byte, c)
 	_, err = rand.Read(b)
 	if err != nil {
-		fmt.Println("error:", err)
-		return
+		// Without a key there is no session store, and the first servers.json
+		// request would crash the server. Better to refuse to start.
+		log.Fatalln("Could not generate session cookie key:", err)
+	}
+
+	// A generated key means SAML users log in again after a restart, and that
+	// all instances behind a load balancer need the same --saml-flag-key.
+	samlFlagKey = []byte(viper.GetString("web.saml-flag-key"))
+	if len(samlFlagKey) == 0 {
+		samlFlagKey = b
+	} else if k, err := hex.DecodeString(string(samlFlagKey)); err == nil {
+		samlFlagKey = k
+	}
+
+	// The session holds the servers.json password, so it is encrypted as well
+	// as signed. A generated key, like the signing key above, does not survive a
+	// restart and is not shared between instances.
+	encKey := []byte(viper.GetString("web.session-encryption-key"))
+	if len(encKey) == 0 {
+		encKey = make([]byte, 32)
+		if _, err = rand.Read(encKey); err != nil {
+			log.Fatalln("Could not generate session encryption key:", err)
+		}
+	} else if k, err := hex.DecodeString(string(encKey)); err == nil {
+		encKey = k
+	}
+	switch len(encKey) {
+	case 16, 24, 32:
+	default:
+		log.Fatalln("Session encryption key must be 16, 24 or 32 bytes, or their hex encoding")
+	}
+	// The store only holds the servers.json session, hence the alias
+	sessionMaxAge := viper.GetDuration("web.session-max-age")
+	if viper.IsSet("web.servers-json-session-max-age") {
+		sessionMaxAge = viper.GetDuration("web.servers-json-session-max-age")
 	}
-	sessionStore = sessions.NewCookieStore(b)
-	sessionStore.MaxAge(0)
+	if sessionMaxAge < 0 {
+		log.Fatalln("Session max age must not be negative")
+	}
+	sessionStore = newSessionStore(b, encKey, sessionMaxAge)
 	serversJSONParams = []string{"username", "password", "database"}
 }
 
-func uploadHandler(rw http.ResponseWriter, r *http.Request) {
-	var (
-		status int
-		err    error
-	)
+// contextReader is an io.Reader that stops returning data once its context is
+// done, so that copies honor the context's deadline.
+type contextReader struct {
+	ctx context.Context
+	io.Reader
+}
 
-	defer func() {
-		if err != nil {
-			http.Error(rw, err.Error(), status)
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.Reader.Read(p)
+}
+
+type connContextKey struct{}
+
+// saveConnContext stores the connection in the request context, so that
+// handlers can adjust its deadlines.
+func saveConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// requestConn returns the connection of an HTTP/1 request, which has it to
+// itself until the handler returns. HTTP/2 requests share theirs with other
+// streams, so its deadlines are left to the server and nil is returned.
+func requestConn(r *http.Request) net.Conn {
+	if r.ProtoMajor != 1 {
+		return nil
+	}
+	c, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	return c
+}
+
+// withUploadTimeout bounds the request context by --upload-timeout. A read of
+// the body blocked on a stalled client wouldn't notice, so the read deadline
+// is moved up to interrupt it once the context is done.
+func withUploadTimeout(r *http.Request) (context.Context, context.CancelFunc) {
+	if uploadTimeout <= 0 {
+		return r.Context(), func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), uploadTimeout)
+	c := requestConn(r)
+	if c == nil {
+		return ctx, cancel
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.SetReadDeadline(time.Now())
+		case <-stop:
 		}
 	}()
-
-	err = r.ParseMultipartForm(32 << 20)
-	if err != nil {
-		status = http.StatusInternalServerError
-		return
+	// Waiting for the goroutine keeps it from touching the deadline once the
+	// server has moved on to the connection's next request.
+	return ctx, func() {
+		close(stop)
+		<-stopped
+		cancel()
 	}
+}
 
-	if readOnly {
-		status = http.StatusUnauthorized
-		err = errors.New("Uploads disabled: server running in read-only mode")
+// extendConnDeadline replaces the server-wide read and write deadlines of the
+// request's connection with ones d from now. A grace period is added so that
+// the handler's own timeout fires first and can still write its response.
+func extendConnDeadline(r *http.Request, d time.Duration) {
+	c := requestConn(r)
+	if c == nil || d <= 0 {
 		return
 	}
+	deadline := time.Now().Add(d + 5*time.Second)
+	c.SetReadDeadline(deadline)
+	c.SetWriteDeadline(deadline)
+}
 
-	uploadDir := dataDir + "/mapd_import/"
-	sid := r.Header.Get("sessionid")
-	samlAuthCookie, samlAuthCookieErr := r.Cookie(samlAuthCookieName)
-	sessionIDCookie, sessionIDCookieErr := r.Cookie(thriftSessionCookieName)
-	if samlAuthCookieErr == nil && sessionIDCookieErr == nil && samlAuthCookie.Value == "true" && sessionIDCookie != nil {
-		sid = sessionIDCookie.Value
-	} else if len(r.FormValue("sessionid")) > 0 {
-		sid = r.FormValue("sessionid")
+// isTrustedPeer reports whether the request was made directly by one of the
+// trusted proxies.
+func isTrustedPeer(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
 	}
+	ip := net.ParseIP(host)
+	return ip != nil && containsIP(trustedProxies, ip)
+}
 
-	sessionIDSha256 := sha256.Sum256([]byte(filepath.Base(filepath.Clean(sid))))
-	sessionID := hex.EncodeToString(sessionIDSha256[:])
-	uploadDir = dataDir + "/mapd_import/" + sessionID + "/"
-
-	for _, fhs := range r.MultipartForm.File {
-		for _, fh := range fhs {
-			infile, err := fh.Open()
-			if err != nil {
-				status = http.StatusInternalServerError
-				return
-			}
-			err = os.MkdirAll(uploadDir, 0755)
-			if err != nil {
-				status = http.StatusInternalServerError
-				return
-			}
-			fn := filepath.Base(filepath.Clean(fh.Filename))
-			outfile, err := os.Create(uploadDir + fn)
-			if err != nil {
-				status = http.StatusInternalServerError
-				return
-			}
-			_, err = io.Copy(outfile, infile)
-			if err != nil {
-				status = http.StatusInternalServerError
-				return
-			}
-			fp := filepath.Base(outfile.Name())
-			rw.Write([]byte(fp))
+// uploadSessionID returns the hashed session ID used to name the upload
+// directory for the request. When a trusted session header is configured and no
+// verified session is available, it returns an empty string.
+func uploadSessionID(r *http.Request) string {
+	var sid string
+	if uploadSessionHeader != "" {
+		// Only a trusted proxy can vouch for the session, since any caller could
+		// otherwise claim an arbitrary one. The SAML session is only used for
+		// requests that didn't come through it.
+		if isTrustedPeer(r) {
+			sid = r.Header.Get(uploadSessionHeader)
+		}
+		if samlSession, ok := samlSessionID(r); ok && sid == "" {
+			sid = samlSession
+		}
+		if sid == "" {
+			return ""
+		}
+	} else {
+		sid = r.Header.Get("sessionid")
+		if samlSession, ok := samlSessionID(r); ok {
+			sid = samlSession
+		} else if len(r.FormValue("sessionid")) > 0 {
+			sid = r.FormValue("sessionid")
 		}
 	}
-}
 
-func deleteUploadHandler(rw http.ResponseWriter, r *http.Request) {
-	// not yet implemented
+	sessionIDSha256 := sha256.Sum256([]byte(filepath.Base(filepath.Clean(sid))))
+	return hex.EncodeToString(sessionIDSha256[:])
 }
 
-func recordTiming(name string, dur time.Duration) {
-	t := registry.GetOrRegister(name, metrics.NewTimer())
-	// TODO(andrew): change units to milliseconds if it does not impact other
-	// calculations
-	t.(metrics.Timer).Update(dur)
+// uploadedFile describes a stored upload in the webhook notification.
+type uploadedFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
 }
 
-func recordTimingDuration(name string, then time.Time) {
-	dur := time.Since(then)
-	recordTiming(name, dur)
-}
+// notifyUploadWebhook tells the --upload-webhook URL about a completed upload.
+// It is meant to run in its own goroutine, failures are only logged.
+func notifyUploadWebhook(sessionID string, files []uploadedFile) {
+	payload, _ := json.Marshal(struct {
+		Session string         `json:"session"`
+		Files   []uploadedFile `json:"files"`
+	}{sessionID, files})
 
-// ResponseMultiWriter implements an http.ResponseWriter with support for
-// outputting to an additional io.Writer.
-type ResponseMultiWriter struct {
-	io.Writer
-	http.ResponseWriter
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(uploadWebhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		log.Warnln("Error calling upload webhook:", err)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		log.Warnln("Upload webhook returned", resp.Status)
+	}
 }
 
-func (w *ResponseMultiWriter) writeHeader(c int) {
-	w.ResponseWriter.Header().Del("Content-Length")
-	w.ResponseWriter.WriteHeader(c)
+// uploadPart is a file received in a multipart upload, held in memory or, if
+// large, in a temporary file.
+type uploadPart struct {
+	Filename string
+	content  []byte
+	tmpfile  string
 }
 
-func (w *ResponseMultiWriter) Write(b []byte) (int, error) {
-	h := w.ResponseWriter.Header()
-	h.Del("Content-Length")
-	return w.Writer.Write(b)
+// Open returns the contents of the file.
+func (p *uploadPart) Open() (io.ReadCloser, error) {
+	if p.tmpfile != "" {
+		return os.Open(p.tmpfile)
+	}
+	return ioutil.NopCloser(bytes.NewReader(p.content)), nil
 }
 
-func hasCustomServersJSONParams(r *http.Request) bool {
-	// Checking for form values requires calling ParseForm, which modifies the
-	// request buffer and causes issues with the proxy. Solution is to duplicate
-	// the request body and reset it after reading.
-	b, _ := ioutil.ReadAll(r.Body)
-	rdr1 := ioutil.NopCloser(bytes.NewReader(b))
-	rdr2 := ioutil.NopCloser(bytes.NewReader(b))
-	r.Body = rdr1
-	defer func() { r.Body = rdr2 }()
-	for _, k := range serversJSONParams {
-		if len(r.FormValue(k)) > 0 {
-			return true
+// errTooManyFiles is returned by readUploadForm for uploads carrying more than
+// --max-upload-files files.
+var errTooManyFiles = errors.New("too many files")
+
+// readUploadForm reads a multipart upload the way ParseMultipartForm does,
+// keeping up to maxMemory bytes in memory and spooling larger files to disk.
+// Unlike ParseMultipartForm it counts files as they stream in and stops as
+// soon as there are more than --max-upload-files, without spooling the rest.
+// Form values are then available from r as usual. The caller must call
+// removeUploadParts on the returned files, even on error.
+func readUploadForm(r *http.Request, maxMemory int64) ([]*uploadPart, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	form := &multipart.Form{Value: make(map[string][]string), File: make(map[string][]*multipart.FileHeader)}
+	var files []*uploadPart
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return files, err
+		}
+
+		if p.FileName() == "" {
+			var b bytes.Buffer
+			n, err := io.CopyN(&b, p, maxMemory+1)
+			if err != nil && err != io.EOF {
+				return files, err
+			}
+			if n > maxMemory {
+				return files, multipart.ErrMessageTooLarge
+			}
+			maxMemory -= n
+			form.Value[p.FormName()] = append(form.Value[p.FormName()], b.String())
+			continue
+		}
+
+		if len(files) == maxUploadFiles {
+			return files, errTooManyFiles
+		}
+		f := &uploadPart{Filename: p.FileName()}
+		files = append(files, f)
+		var b bytes.Buffer
+		n, err := io.CopyN(&b, p, maxMemory+1)
+		if err != nil && err != io.EOF {
+			return files, err
+		}
+		if n <= maxMemory {
+			f.content = b.Bytes()
+			maxMemory -= n
+			continue
+		}
+		tmp, err := ioutil.TempFile("", "multipart-")
+		if err != nil {
+			return files, err
+		}
+		f.tmpfile = tmp.Name()
+		_, err = io.Copy(tmp, io.MultiReader(&b, p))
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return files, err
+		}
+	}
+
+	r.ParseForm()
+	for k, v := range form.Value {
+		r.Form[k] = append(r.Form[k], v...)
+	}
+	r.PostForm = form.Value
+	r.MultipartForm = form
+	return files, nil
+}
+
+// removeUploadParts removes the temporary files of parts spooled to disk.
+func removeUploadParts(files []*uploadPart) {
+	for _, f := range files {
+		if f.tmpfile != "" {
+			os.Remove(f.tmpfile)
+		}
+	}
+}
+
+// uploadChecksum returns the SHA-256 the client expects for the named file,
+// given in a "sha256:<filename>" form field. A plain "sha256" field or
+// X-Upload-SHA256 header covers requests carrying a single file.
+func uploadChecksum(r *http.Request, filename string, nfiles int) string {
+	if v := r.MultipartForm.Value["sha256:"+filename]; len(v) > 0 {
+		return v[0]
+	}
+	if nfiles != 1 {
+		return ""
+	}
+	if v := r.MultipartForm.Value["sha256"]; len(v) > 0 {
+		return v[0]
+	}
+	return r.Header.Get("X-Upload-SHA256")
+}
+
+// sniffLen is how much of a file sniffContentType looks at.
+const sniffLen = 512
+
+// sniffContentType detects the content type of the data in r. It returns a
+// reader that still yields all of the data, including the bytes sniffed.
+func sniffContentType(r io.Reader) (io.Reader, string, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	head = head[:n]
+	return io.MultiReader(bytes.NewReader(head), r), http.DetectContentType(head), err
+}
+
+// uploadTypeAllowed reports whether the sniffed content type ct matches one of
+// allowedUploadTypes, which may end in "/*" to allow a whole top-level type.
+func uploadTypeAllowed(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	for _, t := range allowedUploadTypes {
+		if t == mt || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mt, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadRequiredHeader and uploadRequiredValue are the header uploads must
+// carry, from --upload-required-header.
+var (
+	uploadRequiredHeader string
+	uploadRequiredValue  string
+)
+
+// hasUploadRequiredHeader reports whether r carries --upload-required-header,
+// if one is configured.
+func hasUploadRequiredHeader(r *http.Request) bool {
+	if uploadRequiredHeader == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(uploadRequiredHeader)), []byte(uploadRequiredValue)) == 1
+}
+
+func uploadHandler(rw http.ResponseWriter, r *http.Request) {
+	var (
+		status int
+		err    error
+		stored []string
+	)
+
+	// Uploads get their own deadline rather than the server-wide --timeout.
+	extendConnDeadline(r, uploadTimeout)
+
+	ctx, cancel := withUploadTimeout(r)
+	defer cancel()
+	if uploadTimeout > 0 {
+		r.Body = ioutil.NopCloser(contextReader{ctx, r.Body})
+	}
+
+	var uploaded int64
+	defer func() {
+		if err == nil {
+			markMeter("upload.count", 1)
+			markMeter("upload.bytes", uploaded)
+		}
+	}()
+
+	defer func() {
+		if err != nil {
+			markMeter("upload.failures", 1)
+
+			// Don't leave partially written uploads behind
+			for _, fn := range stored {
+				os.Remove(fn)
+			}
+			if ctx.Err() == context.DeadlineExceeded {
+				status = http.StatusRequestTimeout
+				err = errors.New("Upload exceeded maximum duration of " + uploadTimeout.String())
+			}
+			http.Error(rw, err.Error(), status)
+		}
+	}()
+
+	// Refuse before reading any of the body, which would otherwise be parsed
+	// and spooled to disk only to be thrown away.
+	if isReadOnly() {
+		status = http.StatusUnauthorized
+		err = errors.New("Uploads disabled: server running in read-only mode")
+		return
+	}
+	if !hasUploadRequiredHeader(r) {
+		status = http.StatusForbidden
+		err = errors.New("Forbidden")
+		return
+	}
+
+	if strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		if !uploadContinue {
+			status = http.StatusExpectationFailed
+			err = errors.New("Expect: 100-continue is not supported for uploads")
+			return
+		}
+
+		// The interim "100 Continue" response is sent on the first read of the
+		// body. Trigger it now so the client starts the transfer immediately
+		// instead of waiting out its own expect timeout.
+		r.Body.Read(nil)
+	}
+
+	parts, err := readUploadForm(r, 32<<20)
+	defer removeUploadParts(parts)
+	if err == errTooManyFiles {
+		status = http.StatusBadRequest
+		err = errors.New("Too many files in upload, limit " + strconv.Itoa(maxUploadFiles))
+		return
+	}
+	if err != nil {
+		status = http.StatusInternalServerError
+		return
+	}
+
+	sessionID := uploadSessionID(r)
+	if sessionID == "" {
+		status = http.StatusUnauthorized
+		err = errors.New("Uploads require a verified session")
+		return
+	}
+	uploadDir := dataDir + "/mapd_import/" + sessionID + "/"
+
+	var files []uploadedFile
+	for _, fh := range parts {
+		var (
+			infile  io.ReadCloser
+			outfile *os.File
+		)
+		infile, err = fh.Open()
+		if err != nil {
+			status = http.StatusInternalServerError
+			return
+		}
+		var src io.Reader = infile
+		if len(allowedUploadTypes) > 0 {
+			var ct string
+			src, ct, err = sniffContentType(infile)
+			if err == nil && !uploadTypeAllowed(ct) {
+				err = errors.New("Content type " + ct + " of " + fh.Filename + " is not allowed")
+			}
+			if err != nil {
+				infile.Close()
+				status = http.StatusUnsupportedMediaType
+				return
+			}
+		}
+		err = os.MkdirAll(uploadDir, 0755)
+		if err != nil {
+			infile.Close()
+			status = http.StatusInternalServerError
+			return
+		}
+		fn := filepath.Base(filepath.Clean(fh.Filename))
+		outfile, err = os.Create(uploadDir + fn)
+		if err != nil {
+			infile.Close()
+			status = http.StatusInternalServerError
+			return
+		}
+		stored = append(stored, outfile.Name())
+		sum := sha256.New()
+		var n int64
+		n, err = io.Copy(io.MultiWriter(outfile, sum), contextReader{ctx, src})
+		uploaded += n
+		infile.Close()
+		outfile.Close()
+		if err != nil {
+			status = http.StatusInternalServerError
+			return
+		}
+		if expected := uploadChecksum(r, fh.Filename, len(parts)); expected != "" && !strings.EqualFold(expected, hex.EncodeToString(sum.Sum(nil))) {
+			status = http.StatusUnprocessableEntity
+			err = errors.New("SHA-256 mismatch for " + fn)
+			return
+		}
+		files = append(files, uploadedFile{filepath.Base(outfile.Name()), n})
+	}
+
+	for _, f := range files {
+		rw.Write([]byte(f.Name))
+	}
+
+	if uploadWebhook != "" && len(files) > 0 {
+		go notifyUploadWebhook(sessionID, files)
+	}
+}
+
+// resumableUpload is the state of an upload to /upload/resumable, stored next
+// to its partial data.
+type resumableUpload struct {
+	Filename string `json:"filename"`
+	Length   int64  `json:"length"`
+}
+
+// resumableLocks serializes chunks of the same upload. Locks are only made
+// for uploads that were started, and are removed with them.
+var resumableLocks sync.Map
+
+// parseContentRange parses a "bytes <start>-<end>/<total>" Content-Range.
+func parseContentRange(v string) (start, end, total int64, err error) {
+	_, err = fmt.Sscanf(v, "bytes %d-%d/%d", &start, &end, &total)
+	if err == nil && (start < 0 || end < start || end >= total) {
+		err = errors.New("invalid range " + v)
+	}
+	return
+}
+
+// resumableUploadHandler lets large files be uploaded in chunks that can be
+// resumed after a dropped connection:
+//
+//	POST /upload/resumable?filename=<name> with an Upload-Length header starts
+//	an upload and returns its URL in Location.
+//	PUT <location> with Content-Range: bytes <start>-<end>/<total> stores a
+//	chunk, which must begin at the current offset.
+//	HEAD <location> reports the current offset in Upload-Offset.
+//	DELETE <location> cancels the upload, removing its partial data.
+//
+// Partial data is kept under the session's upload directory, and once the
+// last byte arrives the file is moved next to those sent to /upload.
+func resumableUploadHandler(rw http.ResponseWriter, r *http.Request) {
+	extendConnDeadline(r, uploadTimeout)
+
+	if isReadOnly() {
+		http.Error(rw, "Uploads disabled: server running in read-only mode", http.StatusUnauthorized)
+		return
+	}
+	if !hasUploadRequiredHeader(r) {
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return
+	}
+	// Chunks are raw file data, which uploadSessionID must not parse as a form.
+	body := r.Body
+	if r.Method != "POST" {
+		r.Body = http.NoBody
+	}
+	sessionID := uploadSessionID(r)
+	r.Body = body
+	if sessionID == "" {
+		http.Error(rw, "Uploads require a verified session", http.StatusUnauthorized)
+		return
+	}
+	uploadDir := dataDir + "/mapd_import/" + sessionID + "/"
+	partDir := uploadDir + ".resumable/"
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/upload/resumable"), "/")
+	if id == "" {
+		if r.Method != "POST" {
+			rw.Header().Set("Allow", "POST")
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		filename := filepath.Base(filepath.Clean(r.FormValue("filename")))
+		if filename == "." || filename == "/" || filename == ".resumable" {
+			http.Error(rw, "Missing or invalid filename", http.StatusBadRequest)
+			return
+		}
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length <= 0 {
+			http.Error(rw, "Upload-Length header must be a positive number of bytes", http.StatusBadRequest)
+			return
+		}
+		id = uuid.New().String()
+		meta, _ := json.Marshal(resumableUpload{filename, length})
+		err = os.MkdirAll(partDir, 0755)
+		if err == nil {
+			err = ioutil.WriteFile(partDir+id+".json", meta, 0644)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(partDir+id, nil, 0644)
+		}
+		if err != nil {
+			markMeter("upload.failures", 1)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Location", "/upload/resumable/"+id)
+		rw.Header().Set("Upload-Offset", "0")
+		rw.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	var meta resumableUpload
+	if _, err := uuid.Parse(id); err != nil {
+		http.NotFound(rw, r)
+		return
+	}
+	b, err := ioutil.ReadFile(partDir + id + ".json")
+	if err == nil {
+		err = json.Unmarshal(b, &meta)
+	}
+	if err != nil {
+		http.NotFound(rw, r)
+		return
+	}
+
+	l, _ := resumableLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := l.(*sync.Mutex)
+	mu.Lock()
+	defer mu.Unlock()
+
+	fi, err := os.Stat(partDir + id)
+	if err != nil {
+		// Completed or removed while waiting for the lock
+		resumableLocks.Delete(id)
+		http.NotFound(rw, r)
+		return
+	}
+	offset := fi.Size()
+	rw.Header().Set("Upload-Length", strconv.FormatInt(meta.Length, 10))
+	rw.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+
+	switch r.Method {
+	case "HEAD":
+		rw.Header().Set("Cache-Control", "no-store")
+		return
+	case "DELETE":
+		if err := os.Remove(partDir + id); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		os.Remove(partDir + id + ".json")
+		resumableLocks.Delete(id)
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	case "PUT", "PATCH":
+	default:
+		rw.Header().Set("Allow", "HEAD, PUT, PATCH, DELETE")
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil || total != meta.Length {
+		http.Error(rw, "Content-Range must be bytes <start>-<end>/"+strconv.FormatInt(meta.Length, 10), http.StatusBadRequest)
+		return
+	}
+	if start != offset {
+		http.Error(rw, "Chunk does not start at the current offset "+strconv.FormatInt(offset, 10), http.StatusConflict)
+		return
+	}
+
+	ctx, cancel := withUploadTimeout(r)
+	defer cancel()
+
+	// The content type can only be sniffed from the start of the file. A first
+	// chunk with all of the bytes sniffed is refused before it is stored, the
+	// type of files sent in smaller chunks is checked once they are complete.
+	var chunk io.Reader = io.LimitReader(r.Body, end-start+1)
+	if len(allowedUploadTypes) > 0 && start == 0 && (end+1 >= sniffLen || end+1 == meta.Length) {
+		var ct string
+		chunk, ct, err = sniffContentType(chunk)
+		if err == nil && !uploadTypeAllowed(ct) {
+			err = errors.New("Content type " + ct + " of " + meta.Filename + " is not allowed")
+		}
+		if err != nil {
+			markMeter("upload.failures", 1)
+			http.Error(rw, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	f, err := os.OpenFile(partDir+id, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		markMeter("upload.failures", 1)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	n, err := io.Copy(f, contextReader{ctx, chunk})
+	f.Close()
+	offset += n
+	rw.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if err == nil && n != end-start+1 {
+		err = errors.New("Chunk ended after " + strconv.FormatInt(n, 10) + " bytes")
+	}
+	if err != nil {
+		// Whatever arrived is kept, the client resumes from Upload-Offset.
+		markMeter("upload.failures", 1)
+		status := http.StatusBadRequest
+		if ctx.Err() == context.DeadlineExceeded {
+			status = http.StatusRequestTimeout
+		}
+		http.Error(rw, err.Error(), status)
+		return
+	}
+
+	if offset < meta.Length {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if len(allowedUploadTypes) > 0 {
+		var ct string
+		f, err := os.Open(partDir + id)
+		if err == nil {
+			_, ct, err = sniffContentType(f)
+			f.Close()
+		}
+		if err != nil {
+			markMeter("upload.failures", 1)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !uploadTypeAllowed(ct) {
+			os.Remove(partDir + id)
+			os.Remove(partDir + id + ".json")
+			resumableLocks.Delete(id)
+			markMeter("upload.failures", 1)
+			http.Error(rw, "Content type "+ct+" of "+meta.Filename+" is not allowed", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	if err := os.Rename(partDir+id, uploadDir+meta.Filename); err != nil {
+		markMeter("upload.failures", 1)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	os.Remove(partDir + id + ".json")
+	resumableLocks.Delete(id)
+
+	markMeter("upload.count", 1)
+	markMeter("upload.bytes", meta.Length)
+	rw.Write([]byte(meta.Filename))
+
+	if uploadWebhook != "" {
+		go notifyUploadWebhook(sessionID, []uploadedFile{{meta.Filename, meta.Length}})
+	}
+}
+
+func deleteUploadHandler(rw http.ResponseWriter, r *http.Request) {
+	// not yet implemented
+}
+
+// uploadCleanup summarizes a pass of reapUploads.
+type uploadCleanup struct {
+	Removed    int   `json:"removed"`
+	BytesFreed int64 `json:"bytes_freed"`
+}
+
+// reapUploads removes the per-session upload directories in which nothing has
+// been modified for longer than ttl.
+func reapUploads(ttl time.Duration) (uploadCleanup, error) {
+	var res uploadCleanup
+	importDir := dataDir + "/mapd_import/"
+	entries, err := ioutil.ReadDir(importDir)
+	if os.IsNotExist(err) {
+		return res, nil
+	} else if err != nil {
+		return res, err
+	}
+
+	cutoff := time.Now().Add(-ttl)
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(importDir, e.Name())
+		latest := e.ModTime()
+		var size int64
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if fi.ModTime().After(latest) {
+				latest = fi.ModTime()
+			}
+			if !fi.IsDir() {
+				size += fi.Size()
+			}
+			return nil
+		})
+		if latest.After(cutoff) {
+			continue
+		}
+		started, _ := filepath.Glob(filepath.Join(dir, ".resumable", "*.json"))
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warnln("Error removing expired upload directory:", err)
+			continue
+		}
+		for _, meta := range started {
+			resumableLocks.Delete(strings.TrimSuffix(filepath.Base(meta), ".json"))
+		}
+		res.Removed++
+		res.BytesFreed += size
+	}
+	return res, nil
+}
+
+// watchUploads periodically removes upload directories older than uploadTTL.
+func watchUploads() {
+	interval := uploadTTL / 2
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	for range time.Tick(interval) {
+		if isReadOnly() {
+			continue
+		}
+		res, err := reapUploads(uploadTTL)
+		if err != nil {
+			log.Errorln("Error cleaning up uploads:", err)
+		} else if res.Removed > 0 {
+			log.Infoln("Removed", res.Removed, "expired upload directories, freeing", res.BytesFreed, "bytes")
+		}
+	}
+}
+
+// cleanupUploadsHandler runs an upload cleanup on demand. The ttl parameter
+// overrides --upload-ttl for this run. It must be positive, since uploads in
+// progress would otherwise be removed too.
+func cleanupUploadsHandler(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if isReadOnly() {
+		http.Error(rw, "Upload cleanup disabled: server running in read-only mode", http.StatusForbidden)
+		return
+	}
+
+	ttl := uploadTTL
+	if len(r.FormValue("ttl")) > 0 {
+		d, err := time.ParseDuration(r.FormValue("ttl"))
+		if err != nil || d <= 0 {
+			http.Error(rw, "Invalid ttl: "+r.FormValue("ttl"), http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	} else if ttl == 0 {
+		http.Error(rw, "No upload TTL configured, pass ttl", http.StatusBadRequest)
+		return
+	}
+
+	res, err := reapUploads(ttl)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infoln("Removed", res.Removed, "expired upload directories on request from", clientIP(r))
+
+	j, _ := json.Marshal(res)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(j)
+}
+
+// parseReverseProxy parses a --reverse-proxy entry. Prefer path=target; the
+// original path:target form is used when no '=' precedes the first ':', as
+// with '/endpoint/:http://host'.
+func parseReverseProxy(rp string) (reverseProxy, error) {
+	sep := "="
+	if eq := strings.Index(rp, "="); eq < 0 || strings.Contains(rp[:eq], ":") {
+		sep = ":"
+	}
+	s := strings.SplitN(rp, sep, 2)
+	if len(s) != 2 {
+		return reverseProxy{}, errors.New("Could not parse reverse proxy string: " + rp)
+	}
+	path := s[0]
+	if len(path) == 0 {
+		return reverseProxy{}, errors.New("Zero-length path passed for reverse proxy: " + rp)
+	}
+	if path[len(path)-1] != '/' {
+		path += "/"
+	}
+	target, err := url.Parse(s[1])
+	if err != nil {
+		return reverseProxy{}, err
+	}
+	if target.Scheme == "" {
+		return reverseProxy{}, errors.New("Missing URL scheme, need full URL including http/https: " + target.String())
+	}
+	if target.Host == "" {
+		return reverseProxy{}, errors.New("Missing host in reverse proxy target: " + rp)
+	}
+	return reverseProxy{path, target, nil}, nil
+}
+
+// parseCIDRs parses a list of CIDRs. Bare IP addresses are accepted as
+// single-host networks.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, errors.New("invalid IP address: " + c)
+			}
+			if ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP of the client making the request. X-Forwarded-For is
+// only honored when the request arrives from a trusted proxy, in which case the
+// right-most address not belonging to a trusted proxy is used.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(trustedProxies, ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, xff := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(xff, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(trustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// clientCert returns the verified certificate the client presented, or nil if
+// there is none.
+func clientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// adminHandler restricts administrative endpoints to clients within
+// adminAllowedCIDRs, if any are configured, and to connections of at least
+// adminMinTLSVersion, if set.
+func adminHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if adminMinTLSVersion != 0 && (r.TLS == nil || r.TLS.Version < adminMinTLSVersion) {
+			http.Error(rw, "Forbidden: TLS version too old", http.StatusForbidden)
+			log.Infoln("Denied admin request over insufficient TLS from", r.RemoteAddr, "for", r.URL.Path)
+			return
+		}
+		if len(adminAllowedCIDRs) > 0 {
+			ip := clientIP(r)
+			if ip == nil || !containsIP(adminAllowedCIDRs, ip) {
+				http.Error(rw, "Forbidden", http.StatusForbidden)
+				log.Infoln("Denied admin request from", r.RemoteAddr, "for", r.URL.Path)
+				return
+			}
+		}
+		h(rw, r)
+	}
+}
+
+// adminGated reports whether administrative endpoints are kept from the
+// public: served on a listener of their own, limited to adminAllowedCIDRs, or
+// only reachable with a verified client certificate. Endpoints that change
+// the server for everyone are only served if so.
+func adminGated() bool {
+	if separateAdmin || len(adminAllowedCIDRs) > 0 {
+		return true
+	}
+	if !enableHTTPSAuth || httpsClientAuth != tls.RequireAndVerifyClientCert {
+		return false
+	}
+	for _, lc := range listeners {
+		if lc.Handler == "public" && !lc.TLS {
+			return false
+		}
+	}
+	return true
+}
+
+// auditLog returns the logger for runtime changes made by r, which records
+// the client and the subject of its certificate, if any.
+func auditLog(r *http.Request) *log.Entry {
+	fields := log.Fields{"audit": true, "client": clientIP(r).String()}
+	if cert := clientCert(r); cert != nil {
+		fields["subject"] = cert.Subject.String()
+	}
+	return log.WithFields(fields)
+}
+
+// redactRequestURI drops the query string of URIs under the logStripQuery
+// prefixes, and otherwise replaces the values of any query parameters listed in
+// logStripParams with "REDACTED", leaving the rest of the URI untouched.
+func redactRequestURI(uri string) string {
+	i := strings.IndexByte(uri, '?')
+	if i < 0 {
+		return uri
+	}
+	for _, prefix := range logStripQuery {
+		if strings.HasPrefix(uri[:i], prefix) {
+			return uri[:i]
+		}
+	}
+	if len(logStripParams) == 0 {
+		return uri
+	}
+
+	params := strings.Split(uri[i+1:], "&")
+	for k, p := range params {
+		kv := strings.SplitN(p, "=", 2)
+		key, err := url.QueryUnescape(kv[0])
+		if err != nil {
+			key = kv[0]
+		}
+		if len(kv) == 2 && logStripParams[strings.ToLower(key)] {
+			params[k] = kv[0] + "=REDACTED"
+		}
+	}
+	return uri[:i+1] + strings.Join(params, "&")
+}
+
+// accessLogHandler writes an Apache Common or Combined Log Format entry, per
+// --access-log-format, to out for every request, with sensitive query
+// parameters redacted. The client is the one found by clientIP, rather than
+// the proxy the request came through.
+func accessLogHandler(out io.Writer, h http.Handler) http.Handler {
+	logger := handlers.LoggingHandler
+	if accessLogFormat == "combined" {
+		logger = handlers.CombinedLoggingHandler
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// The logger only sees a copy of the request with the redacted URI, while
+		// the wrapped handler still gets the original.
+		lr := r.WithContext(r.Context())
+		lr.RequestURI = redactRequestURI(r.RequestURI)
+		if ip := clientIP(r); ip != nil {
+			lr.RemoteAddr = ip.String()
+		}
+		lh := logger(out, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+			h.ServeHTTP(rw, r)
+		}))
+		lh.ServeHTTP(rw, lr)
+	})
+}
+
+// requestIDHeader carries request IDs, per --request-id-header
+var requestIDHeader = "X-Request-Id"
+
+type requestIDContextKey struct{}
+
+// requestIDHandler assigns every request an ID, taken from the requestIDHeader
+// header if the client or a proxy already set a usable one. The ID is echoed in
+// the response so that it can be matched against per-request timings. It is
+// set before any other handler runs, so that error responses carry it too.
+func requestIDHandler(h http.Handler) http.Handler {
+	valid := regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !valid.MatchString(id) {
+			id = uuid.New().String()
+			r.Header.Set(requestIDHeader, id)
+		}
+		rw.Header().Set(requestIDHeader, id)
+		h.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id)))
+	})
+}
+
+// requestID returns the ID assigned to r by requestIDHandler.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// requestTiming is the timing breakdown of a single Thrift call.
+type requestTiming struct {
+	RequestID     string             `json:"request_id"`
+	Method        string             `json:"method"`
+	Client        string             `json:"client"`
+	Start         time.Time          `json:"start"`
+	DurationMs    float64            `json:"duration_ms"`
+	RequestBytes  int64              `json:"request_bytes"`
+	ResponseBytes int64              `json:"response_bytes"`
+	Timings       map[string]float64 `json:"timings_ms,omitempty"`
+}
+
+var (
+	requestTimingsMutex sync.Mutex
+	requestTimings      []requestTiming
+	requestTimingsNext  int
+)
+
+// recordRequestTiming adds t to the ring buffer of recent request timings,
+// overwriting the oldest entry once it is full.
+func recordRequestTiming(t requestTiming) {
+	if requestTimingsSize <= 0 {
+		return
+	}
+	requestTimingsMutex.Lock()
+	defer requestTimingsMutex.Unlock()
+	if len(requestTimings) < requestTimingsSize {
+		requestTimings = append(requestTimings, t)
+		return
+	}
+	requestTimings[requestTimingsNext] = t
+	requestTimingsNext = (requestTimingsNext + 1) % requestTimingsSize
+}
+
+// requestTimingsHandler lists the recent per-request timings, newest first,
+// optionally limited to the request with the given id.
+func requestTimingsHandler(rw http.ResponseWriter, r *http.Request) {
+	id := r.FormValue("id")
+
+	requestTimingsMutex.Lock()
+	out := make([]requestTiming, 0, len(requestTimings))
+	for i := len(requestTimings) - 1; i >= 0; i-- {
+		t := requestTimings[(requestTimingsNext+i)%len(requestTimings)]
+		if id == "" || t.RequestID == id {
+			out = append(out, t)
+		}
+	}
+	requestTimingsMutex.Unlock()
+
+	rw.Header().Set("Content-Type", "application/json")
+	ijson, _ := json.MarshalIndent(out, "", "  ")
+	rw.Write(ijson)
+}
+
+func recordTiming(name string, dur time.Duration) {
+	t := registry.GetOrRegister(name, metrics.NewTimer())
+	// TODO(andrew): change units to milliseconds if it does not impact other
+	// calculations
+	t.(metrics.Timer).Update(dur)
+}
+
+// recordSize adds a payload size to the named histogram.
+func recordSize(name string, n int64) {
+	h := registry.GetOrRegister(name, func() metrics.Histogram {
+		return metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
+	})
+	h.(metrics.Histogram).Update(n)
+}
+
+// serverErrorLog receives the http.Server's own error log, picking out TLS
+// handshake failures so they are logged with the client and reason and counted.
+type serverErrorLog struct{}
+
+func (serverErrorLog) Write(b []byte) (int, error) {
+	msg := strings.TrimSpace(string(b))
+	const handshakeError = "http: TLS handshake error from "
+	if !strings.HasPrefix(msg, handshakeError) {
+		log.Warnln(msg)
+		return len(b), nil
+	}
+
+	client, reason := strings.TrimPrefix(msg, handshakeError), ""
+	if i := strings.Index(client, ": "); i >= 0 {
+		client, reason = client[:i], client[i+2:]
+	}
+	markMeter("tls.handshake_errors", 1)
+	entry := log.WithFields(log.Fields{"client": client, "reason": reason})
+	// Load balancer TCP checks connect and hang up without a handshake.
+	if reason == "EOF" {
+		entry.Debugln("TLS handshake failed")
+	} else {
+		entry.Warnln("TLS handshake failed")
+	}
+	return len(b), nil
+}
+
+// markMeter records n events on the named meter.
+func markMeter(name string, n int64) {
+	if !enableMetrics {
+		return
+	}
+	m := registry.GetOrRegister(name, metrics.NewMeter)
+	m.(metrics.Meter).Mark(n)
+}
+
+func recordTimingDuration(name string, then time.Time) {
+	dur := time.Since(then)
+	recordTiming(name, dur)
+}
+
+// ResponseMultiWriter implements an http.ResponseWriter with support for
+// outputting to an additional io.Writer. The client is written first, and only
+// what it accepted is copied to the additional Writer, whose errors are ignored,
+// so the returned count and error always describe what the client received.
+type ResponseMultiWriter struct {
+	io.Writer
+	http.ResponseWriter
+	gz      *gunzipWriter
+	started bool
+}
+
+func (w *ResponseMultiWriter) writeHeader(c int) {
+	w.ResponseWriter.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(c)
+}
+
+func (w *ResponseMultiWriter) Write(b []byte) (int, error) {
+	h := w.ResponseWriter.Header()
+	h.Del("Content-Length")
+	// A gzipped response passed through to the client is teed decompressed.
+	// The header alone could also come from compression further out, which
+	// hasn't happened yet, so check the data is gzip.
+	if !w.started {
+		w.started = true
+		if h.Get("Content-Encoding") == "gzip" && len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b {
+			w.gz = newGunzipWriter(w.Writer)
+			w.Writer = w.gz
+		}
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if n > 0 {
+		w.Writer.Write(b[:n])
+	}
+	return n, err
+}
+
+// Close waits for a gzipped response to be fully decompressed into Writer.
+func (w *ResponseMultiWriter) Close() error {
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
+
+func (w *ResponseMultiWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// gunzipWriter decompresses the gzip stream written to it into another writer.
+type gunzipWriter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+}
+
+func newGunzipWriter(w io.Writer) *gunzipWriter {
+	pr, pw := io.Pipe()
+	g := &gunzipWriter{pw, make(chan struct{})}
+	go func() {
+		defer close(g.done)
+		if zr, err := gzip.NewReader(pr); err == nil {
+			io.Copy(w, zr)
+		}
+		// Keep consuming a stream that is corrupt or has trailing data, so
+		// that writes never block.
+		io.Copy(ioutil.Discard, pr)
+	}()
+	return g
+}
+
+func (g *gunzipWriter) Write(b []byte) (int, error) {
+	return g.pw.Write(b)
+}
+
+func (g *gunzipWriter) Close() error {
+	g.pw.Close()
+	<-g.done
+	return nil
+}
+
+// tailBuffer is an io.Writer that retains only the most recent bytes written to
+// it, up to the size of its buffer.
+type tailBuffer struct {
+	buf  []byte
+	pos  int
+	full bool
+}
+
+func newTailBuffer(size int) *tailBuffer {
+	return &tailBuffer{buf: make([]byte, size)}
+}
+
+func (t *tailBuffer) Write(b []byte) (int, error) {
+	n := len(b)
+	if n >= len(t.buf) {
+		copy(t.buf, b[n-len(t.buf):])
+		t.pos = 0
+		t.full = true
+		return n, nil
+	}
+	if t.pos+n >= len(t.buf) {
+		t.full = true
+	}
+	c := copy(t.buf[t.pos:], b)
+	copy(t.buf, b[c:])
+	t.pos = (t.pos + n) % len(t.buf)
+	return n, nil
+}
+
+// String returns the retained bytes, oldest first.
+func (t *tailBuffer) String() string {
+	if !t.full {
+		return string(t.buf[:t.pos])
+	}
+	return string(t.buf[t.pos:]) + string(t.buf[:t.pos])
+}
+
+// serverHeaderWriter is an http.ResponseWriter that replaces the Server header,
+// such as one passed through from a proxied backend, right before the response
+// headers are sent.
+type serverHeaderWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *serverHeaderWriter) WriteHeader(c int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if serverHeader == "" {
+			w.Header().Del("Server")
+		} else {
+			w.Header().Set("Server", serverHeader)
+		}
+	}
+	w.ResponseWriter.WriteHeader(c)
+}
+
+func (w *serverHeaderWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *serverHeaderWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// serverHeaderHandler strips or overrides the Server header on all responses.
+func serverHeaderHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&serverHeaderWriter{ResponseWriter: rw}, r)
+	})
+}
+
+// isAllowedHost reports whether the request's Host header, with or without its
+// port, is one of allowedHosts.
+func isAllowedHost(r *http.Request) bool {
+	if len(allowedHosts) == 0 {
+		return true
+	}
+	host := strings.ToLower(r.Host)
+	if allowedHosts[host] {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return allowedHosts[strings.Trim(h, "[]")]
+	}
+	return allowedHosts[strings.Trim(host, "[]")]
+}
+
+// allowedHostHandler rejects requests with a missing or unexpected Host header,
+// which would otherwise leak into generated servers.json and redirects.
+func allowedHostHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !isAllowedHost(r) {
+			http.Error(rw, "Invalid Host header", http.StatusBadRequest)
+			return
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// blockedUserAgentHandler refuses requests whose User-Agent matches one of
+// blockedUserAgents.
+func blockedUserAgentHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ua := r.UserAgent()
+		for _, re := range blockedUserAgents {
+			if re.MatchString(ua) {
+				http.Error(rw, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// compressHandler gzips responses, except for Server-Sent Events and gRPC-Web
+// streams, which the compressor would hold back until enough data arrives.
+func compressHandler(h http.Handler) http.Handler {
+	ch := handlers.CompressHandler(h)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") || isGRPCWeb(r) {
+			h.ServeHTTP(rw, r)
+			return
+		}
+		// The compressor only sets Vary on responses it encodes, but the
+		// identity ones vary just as much.
+		if !compressorEncodes(r) {
+			addVary(rw.Header(), "Accept-Encoding")
+		}
+		ch.ServeHTTP(rw, r)
+	})
+}
+
+// compressorEncodes reports whether handlers.CompressHandler will encode the
+// response to r, by the same test it uses.
+func compressorEncodes(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if e := strings.TrimSpace(enc); e == "gzip" || e == "deflate" {
+			return true
+		}
+	}
+	return false
+}
+
+// corsHandler applies the CORS options of reverse proxy routes that have their
+// own, and the global ones everywhere else.
+func corsHandler(c *cors.Cors, mux *http.ServeMux) http.Handler {
+	global := c.Handler(mux)
+	routes := make(map[string]http.Handler)
+	for _, rp := range proxies {
+		if rp.CORS != nil {
+			routes[rp.Path] = rp.CORS.Handler(mux)
+		}
+	}
+	if len(routes) == 0 {
+		return global
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		h, longest := global, ""
+		for p, rh := range routes {
+			if strings.HasPrefix(r.URL.Path, p) && len(p) > len(longest) {
+				h, longest = rh, p
+			}
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// endpointPolicyHandler applies the endpoint policy of the longest matching
+// prefix: requests over its concurrency limit get a 503, its timeout bounds
+// the request context and connection deadlines, and larger bodies are refused
+// with a 413.
+func endpointPolicyHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var p *endpointPolicy
+		for _, ep := range endpointPolicies {
+			if ep.matches(r.URL.Path) {
+				p = ep
+				break
+			}
+		}
+		if p == nil {
+			h.ServeHTTP(rw, r)
+			return
+		}
+
+		if p.slots != nil {
+			select {
+			case p.slots <- struct{}{}:
+				defer func() { <-p.slots }()
+			default:
+				markMeter("endpoint_policy.rejected", 1)
+				rw.Header().Set("Retry-After", "1")
+				http.Error(rw, "Too many concurrent requests", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		if p.MaxBodySize > 0 {
+			if r.ContentLength > p.MaxBodySize {
+				http.Error(rw, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(rw, r.Body, p.MaxBodySize)
+		}
+
+		if p.Timeout > 0 {
+			extendConnDeadline(r, p.Timeout)
+			ctx, cancel := context.WithTimeout(r.Context(), p.Timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// maintenanceHandler answers every request with the maintenance page while
+// maintenance mode is on. The page is read from outside the frontend directory
+// so that it keeps working while the frontend is redeployed.
+func maintenanceHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&maintenanceMode) == 0 || strings.HasPrefix(r.URL.Path, "/admin/") {
+			h.ServeHTTP(rw, r)
+			return
+		}
+
+		rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		rw.Header().Set("Retry-After", "120")
+		page, err := ioutil.ReadFile(maintenanceFile)
+		if maintenanceFile == "" || err != nil {
+			http.Error(rw, "Down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		rw.Write(page)
+	})
+}
+
+// isReadOnly reports whether uploads and other writes are currently refused.
+func isReadOnly() bool {
+	return atomic.LoadInt32(&readOnly) != 0
+}
+
+// readOnlyModeHandler reports read-only mode and, given an enable or disable
+// form value in a POST, switches it at runtime, for use during incidents.
+func readOnlyModeHandler(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST":
+		var change string
+		if len(r.FormValue("enable")) > 0 {
+			atomic.StoreInt32(&readOnly, 1)
+			change = "enabled"
+		} else if len(r.FormValue("disable")) > 0 {
+			atomic.StoreInt32(&readOnly, 0)
+			change = "disabled"
+		}
+		if change != "" {
+			auditLog(r).Warnln("Read-only mode", change)
+		}
+	default:
+		rw.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(rw, "{\"read_only\": %t}\n", isReadOnly())
+}
+
+// readOnlyStatusHandler only reports read-only mode, for servers whose admin
+// endpoints aren't gated.
+func readOnlyStatusHandler(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(rw, "{\"read_only\": %t}\n", isReadOnly())
+}
+
+// bannerHandler reports the banner inserted into index.html and, in a POST,
+// changes it: the enable and disable form values switch it on and off, and
+// html replaces it. The HTML goes into every page, so unless admin endpoints
+// are gated it can only be set with web.banner-html in the config file.
+func bannerHandler(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST":
+		r.ParseForm()
+		html, replace := r.Form["html"]
+		if replace && !adminGated() {
+			http.Error(rw, "Forbidden: banner HTML can only be set in the config file unless admin endpoints are gated", http.StatusForbidden)
+			return
+		}
+		var changes []string
+		if replace {
+			bannerHTML.Store(html[0])
+			changes = append(changes, "replaced")
+		}
+		if len(r.FormValue("enable")) > 0 {
+			atomic.StoreInt32(&bannerEnabled, 1)
+			changes = append(changes, "enabled")
+		} else if len(r.FormValue("disable")) > 0 {
+			atomic.StoreInt32(&bannerEnabled, 0)
+			changes = append(changes, "disabled")
+		}
+		if len(changes) > 0 {
+			auditLog(r).Infoln("Banner", strings.Join(changes, " and "))
+		}
+	default:
+		rw.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	j, _ := json.Marshal(struct {
+		Enabled bool   `json:"enabled"`
+		HTML    string `json:"html"`
+	}{atomic.LoadInt32(&bannerEnabled) != 0, bannerHTML.Load().(string)})
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(append(j, '\n'))
+}
+
+// maintenanceModeHandler reports maintenance mode and, given an enable or
+// disable form value in a POST, toggles it. GETs only report, so that link
+// prefetchers and crawlers can't take the site down.
+func maintenanceModeHandler(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST":
+		if len(r.FormValue("enable")) > 0 {
+			atomic.StoreInt32(&maintenanceMode, 1)
+			auditLog(r).Infoln("Maintenance mode enabled")
+		} else if len(r.FormValue("disable")) > 0 {
+			atomic.StoreInt32(&maintenanceMode, 0)
+			auditLog(r).Infoln("Maintenance mode disabled")
+		}
+	default:
+		rw.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(rw, "{\"maintenance\": %t}\n", atomic.LoadInt32(&maintenanceMode) != 0)
+}
+
+func hasCustomServersJSONParams(r *http.Request) bool {
+	query := r.URL.Query()
+	for _, k := range serversJSONParams {
+		if len(query.Get(k)) > 0 {
+			return true
+		}
+	}
+
+	// Thrift calls and anything else that isn't a form can't carry the
+	// overrides, so their bodies are left alone.
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Body == nil || (ct != "application/x-www-form-urlencoded" && ct != "multipart/form-data") {
+		return false
+	}
+
+	// Checking for form values requires calling ParseForm, which modifies the
+	// request buffer and causes issues with the proxy. Solution is to duplicate
+	// the request body and reset it after reading, up to a limit.
+	body := r.Body
+	b, _ := ioutil.ReadAll(io.LimitReader(body, serversJSONMaxForm+1))
+	restore := struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), body), body}
+	defer func() { r.Body = restore }()
+	if int64(len(b)) > serversJSONMaxForm {
+		return false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	for _, k := range serversJSONParams {
+		if len(r.FormValue(k)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// traceSpan is a span of the OpenTelemetry trace a request belongs to.
+type traceSpan struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	failed   bool
+}
+
+// OTLP span kinds
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+)
+
+type spanContextKey struct{}
+
+var (
+	spanQueue chan *traceSpan
+	// Closing spanStop has the exporter send the spans still queued and
+	// return, after which it closes spanDone.
+	spanStop chan struct{}
+	spanDone chan struct{}
+)
+
+// thriftMethodScanBytes is how much of a Thrift call is buffered to find the
+// method name, which Thrift writes right after the protocol version.
+const thriftMethodScanBytes = 256
+
+// traceparent formats the W3C Trace Context header naming s as the parent.
+func (s *traceSpan) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+// newSpan starts a span. Without a parent it starts a new, sampled trace.
+func newSpan(name string, kind int, parent *traceSpan) *traceSpan {
+	s := &traceSpan{name: name, kind: kind, start: time.Now(), sampled: true, attrs: make(map[string]interface{})}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+		s.sampled = parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// parseTraceparent extracts the caller's span from a W3C traceparent header.
+func parseTraceparent(h string) *traceSpan {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil
+	}
+	s := &traceSpan{}
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil
+	}
+	copy(s.traceID[:], traceID)
+	copy(s.spanID[:], spanID)
+	if s.traceID == ([16]byte{}) || s.spanID == ([8]byte{}) {
+		return nil
+	}
+	s.sampled = flags[0]&1 == 1
+	return s
+}
+
+// finishSpan ends s and queues it for export. Spans are dropped rather than
+// delaying requests when the exporter falls behind.
+func finishSpan(s *traceSpan) {
+	s.end = time.Now()
+	if !s.sampled {
+		return
+	}
+	select {
+	case spanQueue <- s:
+	default:
+	}
+}
+
+// tracingHandler starts a server span for every request, continuing the
+// caller's trace if it sent a traceparent header.
+func tracingHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		s := newSpan("HTTP "+r.Method, spanKindServer, parseTraceparent(r.Header.Get("traceparent")))
+		s.attrs["http.method"] = r.Method
+		s.attrs["http.target"] = redactRequestURI(r.RequestURI)
+		s.attrs["http.client_ip"] = clientIP(r).String()
+		if id := requestID(r); id != "" {
+			s.attrs["http.request_id"] = id
+		}
+
+		if r.Method == "POST" && r.URL.Path == "/" && r.Body != nil {
+			body := r.Body
+			prefix := make([]byte, thriftMethodScanBytes)
+			n, _ := io.ReadFull(body, prefix)
+			prefix = prefix[:n]
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(prefix), body), body}
+			if m := thriftMethodName(prefix); m != "" {
+				s.name = m
+				s.attrs["rpc.system"] = "thrift"
+				s.attrs["rpc.method"] = m
+			}
+		}
+
+		cw := &countingResponseWriter{ResponseWriter: rw}
+		defer func() {
+			if cw.status == 0 {
+				cw.status = http.StatusOK
+			}
+			s.attrs["http.status_code"] = cw.status
+			s.failed = cw.status >= http.StatusInternalServerError
+			finishSpan(s)
+		}()
+		h.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), spanContextKey{}, s)))
+	})
+}
+
+// tracingTransport records a client span for each backend call and passes the
+// trace context on to the backend.
+type tracingTransport struct {
+	http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	parent, ok := req.Context().Value(spanContextKey{}).(*traceSpan)
+	if !ok {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	s := newSpan(parent.name, spanKindClient, parent)
+	s.attrs["http.method"] = req.Method
+	s.attrs["http.url"] = req.URL.String()
+	req.Header.Set("traceparent", s.traceparent())
+
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		s.failed = true
+		s.attrs["error.message"] = err.Error()
+	} else {
+		s.attrs["http.status_code"] = resp.StatusCode
+		s.failed = resp.StatusCode >= http.StatusInternalServerError
+	}
+	finishSpan(s)
+	return resp, err
+}
+
+// otlpSpans encodes spans as an OTLP/JSON trace export request.
+func otlpSpans(spans []*traceSpan) []byte {
+	type value struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+	}
+	type attribute struct {
+		Key   string `json:"key"`
+		Value value  `json:"value"`
+	}
+	type status struct {
+		Code int `json:"code"`
+	}
+	type span struct {
+		TraceID           string      `json:"traceId"`
+		SpanID            string      `json:"spanId"`
+		ParentSpanID      string      `json:"parentSpanId,omitempty"`
+		Name              string      `json:"name"`
+		Kind              int         `json:"kind"`
+		StartTimeUnixNano string      `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+		Attributes        []attribute `json:"attributes"`
+		Status            status      `json:"status"`
+	}
+
+	attr := func(k string, v interface{}) attribute {
+		var s string
+		switch v := v.(type) {
+		case int:
+			s = strconv.Itoa(v)
+			return attribute{k, value{IntValue: &s}}
+		default:
+			s = fmt.Sprint(v)
+			return attribute{k, value{StringValue: &s}}
+		}
+	}
+
+	out := make([]span, 0, len(spans))
+	for _, s := range spans {
+		o := span{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != ([8]byte{}) {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for k, v := range s.attrs {
+			o.Attributes = append(o.Attributes, attr(k, v))
+		}
+		if s.failed {
+			o.Status.Code = 2
+		}
+		out = append(out, o)
+	}
+
+	j, _ := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []attribute{attr("service.name", "omnisci_web_server"), attr("service.version", version)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "omnisci_web_server"},
+				"spans": out,
+			}},
+		}},
+	})
+	return j
+}
+
+// exportSpans sends queued spans to the OTLP/HTTP collector at otelEndpoint in
+// batches, at least every five seconds, until stopSpans stops it.
+func exportSpans() {
+	defer close(spanDone)
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	var batch []*traceSpan
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		resp, err := client.Post(otelEndpoint, "application/json", bytes.NewReader(otlpSpans(batch)))
+		batch = batch[:0]
+		if err != nil {
+			log.Warnln("Error exporting trace spans:", err)
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			log.Warnln("Error exporting trace spans: collector returned", resp.Status)
+		}
+	}
+
+	for {
+		select {
+		case s := <-spanQueue:
+			batch = append(batch, s)
+			if len(batch) >= 512 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-spanStop:
+			for len(spanQueue) > 0 {
+				batch = append(batch, <-spanQueue)
+			}
+			flush()
+			return
+		}
+	}
+}
+
+// stopSpans stops the exporter once it has exported all queued spans, so they
+// aren't lost on shutdown. It gives up after timeout if the collector is slow.
+func stopSpans(timeout time.Duration) {
+	close(spanStop)
+	select {
+	case <-spanDone:
+	case <-time.After(timeout):
+		log.Warnln("Timed out exporting trace spans on shutdown")
+	}
+}
+
+// thriftMethodName returns the name of the Thrift method called by a Thrift
+// JSON request body, or "" if there is none.
+func thriftMethodName(body []byte) string {
+	elems := strings.SplitN(string(body), ",", 3)
+	if len(elems) > 1 {
+		return strings.Trim(elems[1], `"`)
+	}
+	return ""
+}
+
+// backendTimings extracts the timings reported by the backend, as described
+// by tm, from the tail of a Thrift response. It returns nil if there are none.
+func backendTimings(tm thriftMethodTimings, tail string) map[string]time.Duration {
+	offset := strings.LastIndex(tail, tm.Start)
+	if offset < 0 {
+		return nil
+	}
+	found := tm.Regex.FindAllStringSubmatch(tail[offset:], len(tm.Labels))
+	timings := make(map[string]time.Duration, len(found))
+	for k, v := range found {
+		dur, _ := time.ParseDuration(v[1] + tm.Units)
+		timings[tm.Labels[k]] = dur
+	}
+	return timings
+}
+
+// markSlowQuery sets X-OmniSci-Slow-Query on responses to Thrift calls, POSTs
+// to / of target, whose backend reported total time exceeds the budget for
+// their method. Those responses are held back until the timings at their end
+// have arrived, up to slowQueryMaxBuffer bytes; larger ones are passed on
+// unmarked. Anything else, including event streams, is passed on untouched.
+func markSlowQuery(resp *http.Response, target *url.URL) error {
+	if len(slowQueryBudgets) == 0 || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	if resp.Request.Method != "POST" || resp.Request.URL.Path != strings.TrimSuffix(target.Path, "/")+"/" ||
+		isEventStream(resp.Header) || resp.ContentLength > int64(slowQueryMaxBuffer) {
+		return nil
+	}
+	// The response repeats the method name of the call
+	br := bufio.NewReader(resp.Body)
+	prefix, _ := br.Peek(thriftMethodScanBytes)
+	body := struct {
+		io.Reader
+		io.Closer
+	}{br, resp.Body}
+	resp.Body = body
+	method := thriftMethodName(prefix)
+	budget, ok := slowQueryBudgets[method]
+	tm, exists := thriftMethodMap[method]
+	if !ok || !exists {
+		return nil
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(br, int64(slowQueryMaxBuffer)+1))
+	if err != nil {
+		return err
+	}
+	if len(buf) > slowQueryMaxBuffer {
+		body.Reader = io.MultiReader(bytes.NewReader(buf), br)
+		resp.Body = body
+		return nil
+	}
+	body.Reader = bytes.NewReader(buf)
+	resp.Body = body
+	if total, ok := backendTimings(tm, string(buf))["total_time_ms"]; ok && total > budget {
+		resp.Header.Set("X-OmniSci-Slow-Query", "true")
+	}
+	return nil
+}
+
+// maxSessionDatabases bounds the sessions whose database is remembered for
+// per-database metrics.
+const maxSessionDatabases = 10000
+
+var (
+	sessionDatabasesMutex sync.Mutex
+	sessionDatabases      = make(map[string]string)
+)
+
+// rememberSessionDatabase records the database of the session created by a
+// Thrift connect call, given the call and the response to it.
+func rememberSessionDatabase(call, response []byte) {
+	req, err := gabs.ParseJSON(call)
+	if err != nil {
+		return
+	}
+	resp, err := gabs.ParseJSON(response)
+	if err != nil {
+		return
+	}
+	db, _ := req.Index(4).Search("3", "str").Data().(string)
+	session, ok := resp.Index(4).Search("0", "str").Data().(string)
+	if !ok || db == "" {
+		return
+	}
+
+	sessionDatabasesMutex.Lock()
+	defer sessionDatabasesMutex.Unlock()
+	if len(sessionDatabases) >= maxSessionDatabases {
+		// Forget an arbitrary session to make room
+		for k := range sessionDatabases {
+			delete(sessionDatabases, k)
+			break
+		}
+	}
+	sessionDatabases[session] = db
+}
+
+// sessionDatabase returns the database of the session making the Thrift call
+// r with body, as a metric name component, or "" if it isn't known. With a
+// disconnect call the session is forgotten.
+func sessionDatabase(r *http.Request, body []byte) string {
+	loc := samlSessionArgPattern.FindSubmatchIndex(body)
+	if loc == nil {
+		return ""
+	}
+	var session string
+	json.Unmarshal(body[loc[2]:loc[3]], &session)
+	if samlPlaceholders[session] {
+		session, _ = samlSessionID(r)
+	}
+
+	sessionDatabasesMutex.Lock()
+	defer sessionDatabasesMutex.Unlock()
+	db, ok := sessionDatabases[session]
+	if !ok {
+		return ""
+	}
+	if thriftMethodName(body) == "disconnect" {
+		delete(sessionDatabases, session)
+	}
+	// Dots separate the parts of metric names
+	return strings.Map(func(c rune) rune {
+		if c == '.' || unicode.IsSpace(c) {
+			return '_'
+		}
+		return c
+	}, db)
+}
+
+// pendingTimings counts the backend timings still being extracted from
+// responses after thriftTimingHandler returned.
+var pendingTimings sync.WaitGroup
+
+// thriftTimingHandler records timings for all Thrift method calls. It also
+// records timings reported by the backend, as defined by ThriftMethodMap.
+// TODO(andrew): use proper Thrift-generated parser
+func thriftTimingHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" && serversJSONOnRoot && !disableServersJSON && hasCustomServersJSONParams(r) {
+			if err := saveServersJSONParams(rw, r); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Redirect(rw, r, r.URL.Path, http.StatusSeeOther)
+			return
+		}
+
+		if !enableMetrics || r.Method != "POST" || (r.Method == "POST" && r.URL.Path != "/") {
+			h.ServeHTTP(rw, r)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		thriftMethod := thriftMethodName(body)
+
+		if len(thriftMethod) < 1 {
+			h.ServeHTTP(rw, r)
+			return
+		}
+
+		tm, exists := thriftMethodMap[thriftMethod]
+		defer recordTimingDuration("all", time.Now())
+		defer recordTimingDuration(thriftMethod, time.Now())
+		db := ""
+		if perDatabaseMetrics {
+			db = sessionDatabase(r, body)
+		}
+		if db != "" {
+			defer recordTimingDuration("db."+db+"."+thriftMethod, time.Now())
+		}
+
+		rt := requestTiming{
+			RequestID:    requestID(r),
+			Method:       thriftMethod,
+			Client:       clientIP(r).String(),
+			Start:        time.Now(),
+			RequestBytes: int64(len(body)),
+		}
+
+		cw := &countingResponseWriter{ResponseWriter: rw}
+		rw = cw
+		defer func() {
+			recordSize(thriftMethod+".request_bytes", int64(len(body)))
+			recordSize(thriftMethod+".response_bytes", cw.bytes)
+		}()
+
+		if !exists && perDatabaseMetrics && thriftMethod == "connect" {
+			// The session the response carries is needed to tell its database
+			buf := newTailBuffer(4 << 10)
+			mw := &ResponseMultiWriter{
+				Writer:         buf,
+				ResponseWriter: rw,
+			}
+			h.ServeHTTP(mw, r)
+			mw.Close()
+			rememberSessionDatabase(body, []byte(buf.String()))
+			rt.DurationMs = float64(time.Since(rt.Start)) / float64(time.Millisecond)
+			rt.ResponseBytes = cw.bytes
+			recordRequestTiming(rt)
+			return
+		}
+		if !exists {
+			h.ServeHTTP(rw, r)
+			rt.DurationMs = float64(time.Since(rt.Start)) / float64(time.Millisecond)
+			rt.ResponseBytes = cw.bytes
+			recordRequestTiming(rt)
+			return
+		}
+
+		// The timings are at the end of the response, so only its tail needs to
+		// be kept in memory.
+		buf := newTailBuffer(metricsTailBytes)
+		mw := &ResponseMultiWriter{
+			Writer:         buf,
+			ResponseWriter: rw,
+		}
+
+		h.ServeHTTP(mw, r)
+		mw.Close()
+		rt.DurationMs = float64(time.Since(rt.Start)) / float64(time.Millisecond)
+		rt.ResponseBytes = cw.bytes
+
+		pendingTimings.Add(1)
+		go func() {
+			defer pendingTimings.Done()
+			if timings := backendTimings(tm, buf.String()); timings != nil {
+				rt.Timings = make(map[string]float64, len(timings))
+				for label, dur := range timings {
+					recordTiming(thriftMethod+"."+label, dur)
+					if db != "" {
+						recordTiming("db."+db+"."+thriftMethod+"."+label, dur)
+					}
+					rt.Timings[label] = float64(dur) / float64(time.Millisecond)
+				}
+			}
+			recordRequestTiming(rt)
+		}()
+	})
+}
+
+func metricsHandler(rw http.ResponseWriter, r *http.Request) {
+	if len(r.FormValue("enable")) > 0 {
+		enableMetrics = true
+	} else if len(r.FormValue("disable")) > 0 {
+		enableMetrics = false
+	}
+	jsonBuf := new(bytes.Buffer)
+	metrics.WriteJSONOnce(registry, jsonBuf)
+	ijsonBuf := new(bytes.Buffer)
+	json.Indent(ijsonBuf, jsonBuf.Bytes(), "", "  ")
+	rw.Write(ijsonBuf.Bytes())
+}
+
+// rotateFile shifts path to path.1, path.1 to path.2 and so on, dropping
+// anything beyond keep copies. With keep 0 path is simply removed.
+func rotateFile(path string, keep int) error {
+	if keep == 0 {
+		return os.Remove(path)
+	}
+	os.Remove(path + "." + strconv.Itoa(keep))
+	for i := keep - 1; i > 0; i-- {
+		os.Rename(path+"."+strconv.Itoa(i), path+"."+strconv.Itoa(i+1))
+	}
+	return os.Rename(path, path+".1")
+}
+
+// dumpMetrics appends a snapshot of the metrics registry to metricsDumpFile
+// every metricsDumpInterval.
+func dumpMetrics() {
+	for t := range time.Tick(metricsDumpInterval) {
+		if err := writeMetricsSnapshot(t); err != nil {
+			log.Warnln("Error writing metrics dump file:", err)
+		}
+	}
+}
+
+// writeMetricsSnapshot appends a snapshot of the metrics registry, as served by
+// /metrics, to metricsDumpFile. Each snapshot is a single line of JSON with the
+// time t it was taken. The file is rotated once it grows beyond
+// metricsDumpMaxSize.
+func writeMetricsSnapshot(t time.Time) error {
+	jsonBuf := new(bytes.Buffer)
+	metrics.WriteJSONOnce(registry, jsonBuf)
+	line, _ := json.Marshal(struct {
+		Time    time.Time       `json:"time"`
+		Metrics json.RawMessage `json:"metrics"`
+	}{t.UTC(), json.RawMessage(bytes.TrimSpace(jsonBuf.Bytes()))})
+
+	if fi, err := os.Stat(metricsDumpFile); err == nil && fi.Size()+int64(len(line))+1 > metricsDumpMaxSize && fi.Size() > 0 {
+		if err := rotateFile(metricsDumpFile, metricsDumpKeep); err != nil {
+			log.Warnln("Error rotating metrics dump file:", err)
+		}
+	}
+	f, err := os.OpenFile(metricsDumpFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func metricsResetHandler(rw http.ResponseWriter, r *http.Request) {
+	registry.UnregisterAll()
+	metricsHandler(rw, r)
+}
+
+// validateServersJSONParam checks a servers.json override before it is stored
+// in the session cookie and later injected into servers.json.
+func validateServersJSONParam(key, value string) error {
+	if len(value) > serversJSONMaxParam {
+		return errors.New("Invalid " + key + ": longer than " + strconv.Itoa(serversJSONMaxParam) + " bytes")
+	}
+	if !utf8.ValidString(value) {
+		return errors.New("Invalid " + key + ": not valid UTF-8")
+	}
+	for _, c := range value {
+		if unicode.IsControl(c) {
+			return errors.New("Invalid " + key + ": contains control characters")
+		}
+	}
+	return nil
+}
+
+// saveServersJSONParams stores the servers.json overrides from the request in
+// the session. Nothing is stored unless all of them are valid.
+func saveServersJSONParams(rw http.ResponseWriter, r *http.Request) error {
+	for _, key := range serversJSONParams {
+		if err := validateServersJSONParam(key, r.FormValue(key)); err != nil {
+			return err
+		}
+	}
+
+	session, _ := sessionStore.Get(r, "servers-json")
+
+	for _, key := range serversJSONParams {
+		if len(r.FormValue(key)) > 0 {
+			session.Values[key] = r.FormValue(key)
+		}
+	}
+
+	// Browsers drop cookies over 4KB, which would silently lose the overrides.
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values, sessionStore.Codecs...)
+	if err != nil {
+		return errors.New("Could not encode servers.json overrides: " + err.Error())
+	}
+	if n := len(session.Name()) + 1 + len(encoded); n > maxCookieSize {
+		return errors.New("servers.json overrides too large for the session cookie: " + strconv.Itoa(n) + " bytes, limit " + strconv.Itoa(maxCookieSize))
+	}
+
+	return session.Save(r, rw)
+}
+
+func setServersJSONHandler(rw http.ResponseWriter, r *http.Request) {
+	if err := saveServersJSONParams(rw, r); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func clearServersJSONHandler(rw http.ResponseWriter, r *http.Request) {
+	session, _ := sessionStore.Get(r, "servers-json")
+
+	session.Options.MaxAge = -1
+
+	session.Save(r, rw)
+}
+
+func docsHandler(rw http.ResponseWriter, r *http.Request) {
+	if docsCacheTTL > 0 {
+		rw.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(docsCacheTTL.Seconds())))
+	}
+	h := http.StripPrefix("/docs/", http.FileServer(http.Dir(docsDir)))
+	h.ServeHTTP(rw, r)
+}
+
+// samlConnect sends a connect call to the backend. Connection-level failures and
+// 503 responses, as seen while the backend restarts, are retried up to
+// samlConnectRetries times with exponential backoff, for as long as the user is
+// still waiting, after which errBackendUnavailable is returned. Any other
+// response, including a rejected login, is returned as is.
+func samlConnect(ctx context.Context, body []byte) (*http.Response, error) {
+	client := &http.Client{Transport: backendTransport}
+	if otelEndpoint != "" {
+		client.Transport = tracingTransport{backendTransport}
+	}
+	backoff := 250 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("POST", backendURL.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/vnd.apache.thrift.json")
+		resp, err := client.Do(req.WithContext(ctx))
+		if err == nil && resp.StatusCode != http.StatusServiceUnavailable {
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = errors.New("backend returned " + resp.Status)
+		}
+		if attempt >= samlConnectRetries {
+			return nil, fmt.Errorf("%w: %v", errBackendUnavailable, err)
+		}
+		log.Infoln("Retrying SAML connect in", backoff, "after error:", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// errBackendUnavailable is returned by samlConnect when the backend could not
+// be reached, as opposed to rejecting the login.
+var errBackendUnavailable = errors.New("backend temporarily unavailable")
+
+// errNonThriftResponse is returned when the backend, or more likely something
+// between it and us, answers with something other than a Thrift JSON message.
+var errNonThriftResponse = errors.New("backend returned non-Thrift response")
+
+// checkThriftResponse verifies that a backend response looks like a Thrift JSON
+// message, rather than an empty body or an error page from an intermediary.
+func checkThriftResponse(resp *http.Response, body []byte) error {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return fmt.Errorf("%v: empty body, status %s", errNonThriftResponse, resp.Status)
+	}
+	if body = bytes.TrimSpace(body); body[0] != '[' {
+		return fmt.Errorf("%v: status %s, content type %q", errNonThriftResponse, resp.Status, resp.Header.Get("Content-Type"))
+	}
+	return nil
+}
+
+// samlPostHandler receives a XML SAML payload from a provider (e.g. Okta) and
+// then makes a connect call to OmniSciDB with the base64'd payload. If the call succeeds
+// we then set a session cookie (`omnisci_session`) for Immerse to use for login, as well
+// as the username (`omnisci_username`) and db name (`omnisci_db`).
+func samlPostHandler(rw http.ResponseWriter, r *http.Request) {
+	var err error
+	ok := false
+	targetPage := "/"
+	// Tells the error page why the login failed
+	reason := "rejected"
+
+	defer func() {
+		if ok {
+			http.Redirect(rw, r, targetPage, 301)
+		} else {
+			var errorString string
+			if err != nil {
+				errorString = err.Error()
+			} else {
+				errorString = "invalid credentials"
+			}
+			http.Redirect(rw, r, samlErrorPage+"?reason="+reason, 303)
+			log.Infoln("Error logging user in via SAML: ", errorString)
+		}
+	}()
+
+	if r.Method == "POST" {
+		var sessionToken string
+
+		b64ResponseXML := r.FormValue("SAMLResponse")
+
+		// This is what a Thrift connect call to OmniSciDB looks like. Here, the username and database
+		// name are left blank, per SAML login conventions. Hand-crafting Thrift messages like this
+		// isn't exactly "best practices", but it beats importing a whole Thrift lib for just this.
+		var jsonString = []byte(`[1,"connect",1,0,{"2":{"str":"` + b64ResponseXML + `"},"3":{"str":""}}]`)
+
+		var resp *http.Response
+		resp, err = samlConnect(r.Context(), jsonString)
+		if err != nil {
+			if errors.Is(err, errBackendUnavailable) {
+				reason = "backend-unavailable"
+			}
+			return
+		}
+
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if err = checkThriftResponse(resp, bodyBytes); err != nil {
+			reason = "non-thrift-response"
+			return
+		}
+
+		var jsonParsed *gabs.Container
+		jsonParsed, err = gabs.ParseJSON(bodyBytes)
+		if err != nil {
+			reason = "non-thrift-response"
+			err = fmt.Errorf("%v: %v", errNonThriftResponse, err)
+			return
+		}
+
+		relayState := r.FormValue("RelayState")
+		if relayState != "" {
+			targetPage = relayState
+		}
+
+		// We should have one of the two following payloads at this point:
+		// 		Success => [1,"connect",2,0,{"0":{"str":"5h6KW9NTv1ef1kOfOlAGN9q63usKOg0i"}}]
+		// 		Failure => [1,"connect",2,0,{"1":{"rec":{"1":{"str":"Invalid credentials."}}}}]
+		// Only set the cookie if we can parse a success payload.
+		sessionToken, ok = jsonParsed.Index(4).Search("0", "str").Data().(string)
+		if ok {
+			sessionIDCookie := http.Cookie{
+				Name:     thriftSessionCookieName,
+				Value:    sessionToken,
+				HttpOnly: true,
+			}
+			http.SetCookie(rw, &sessionIDCookie)
+
+			samlFlagCookie := http.Cookie{
+				Name:  samlAuthCookieName,
+				Value: "true",
+			}
+			http.SetCookie(rw, &samlFlagCookie)
+
+			samlSignatureCookie := http.Cookie{
+				Name:     samlSignatureCookieName,
+				Value:    samlSignature(sessionToken),
+				HttpOnly: true,
+			}
+			http.SetCookie(rw, &samlSignatureCookie)
+		} else if msg, found := jsonParsed.Index(4).Search("1", "rec", "1", "str").Data().(string); found {
+			err = errors.New(msg)
+		}
+	}
+}
+
+// samlSignature returns the HMAC binding the SAML flag cookie to sessionID.
+func samlSignature(sessionID string) string {
+	mac := hmac.New(sha256.New, samlFlagKey)
+	mac.Write([]byte(samlAuthCookieName + "=true;" + sessionID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// samlSessionID returns the real session ID from the cookies set by SAML login.
+// The JavaScript visible flag cookie can be set by anyone, so it is only
+// honored together with the server's signature of the session.
+func samlSessionID(r *http.Request) (string, bool) {
+	flag, err := r.Cookie(samlAuthCookieName)
+	if err != nil || flag.Value != "true" {
+		return "", false
+	}
+	session, err := r.Cookie(thriftSessionCookieName)
+	if err != nil {
+		return "", false
+	}
+	sig, err := r.Cookie(samlSignatureCookieName)
+	if err != nil || !hmac.Equal([]byte(sig.Value), []byte(samlSignature(session.Value))) {
+		return "", false
+	}
+	return session.Value, true
+}
+
+// overlayFileSystem serves each file from the first of its file systems that
+// has it.
+type overlayFileSystem []http.FileSystem
+
+func (ofs overlayFileSystem) Open(name string) (http.File, error) {
+	var err error
+	for _, fs := range ofs {
+		var file http.File
+		file, err = fs.Open(name)
+		if err == nil {
+			return file, nil
+		}
+	}
+	return nil, err
+}
+
+type ServeIndexOn404FileSystem struct {
+	http.FileSystem
+	Filename string
+}
+
+func (fs ServeIndexOn404FileSystem) Open(name string) (http.File, error) {
+	file, err := fs.FileSystem.Open(name)
+	if os.IsNotExist(err) {
+		if strings.HasPrefix(name, "/beta/") {
+			file, err = fs.FileSystem.Open("/beta/index.html")
+		} else {
+			file, err = fs.FileSystem.Open("/index.html")
+		}
+	}
+
+	if err == nil {
+		if stat, statErr := file.Stat(); statErr == nil {
+			fs.Filename = stat.Name()
+		}
+	}
+
+	return file, err
+}
+
+// frontendFileError returns why the named frontend file can't be served, or nil
+// if it can.
+func frontendFileError(name string) error {
+	f, err := frontendFS.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err == nil && fi.IsDir() {
+		err = errors.New("is a directory")
+	}
+	return err
+}
+
+// bannerMarker marks where in index.html the banner goes. Without it the banner
+// follows the opening body tag.
+const bannerMarker = "<!-- omnisci-banner -->"
+
+var bodyTagPattern = regexp.MustCompile(`(?i)<body[^>]*>`)
+
+// insertBanner returns page with banner inserted after bannerMarker or the
+// opening body tag, or page unchanged if it has neither.
+func insertBanner(page []byte, banner string) []byte {
+	at := -1
+	if i := bytes.Index(page, []byte(bannerMarker)); i >= 0 {
+		at = i + len(bannerMarker)
+	} else if loc := bodyTagPattern.FindIndex(page); loc != nil {
+		at = loc[1]
+	}
+	if at < 0 {
+		return page
+	}
+	out := make([]byte, 0, len(page)+len(banner))
+	out = append(out, page[:at]...)
+	out = append(out, banner...)
+	return append(out, page[at:]...)
+}
+
+// bannerResponseWriter holds back a successful HTML response so that the
+// banner can be inserted before it is sent by finish. Other responses pass
+// straight through.
+type bannerResponseWriter struct {
+	http.ResponseWriter
+	banner  string
+	buf     bytes.Buffer
+	hold    bool
+	started bool
+}
+
+func (bw *bannerResponseWriter) WriteHeader(status int) {
+	if bw.started {
+		return
+	}
+	bw.started = true
+	if status == http.StatusOK && strings.HasPrefix(bw.Header().Get("Content-Type"), "text/html") {
+		bw.hold = true
+		return
+	}
+	bw.ResponseWriter.WriteHeader(status)
+}
+
+func (bw *bannerResponseWriter) Write(b []byte) (int, error) {
+	if !bw.started {
+		bw.WriteHeader(http.StatusOK)
+	}
+	if bw.hold {
+		return bw.buf.Write(b)
+	}
+	return bw.ResponseWriter.Write(b)
+}
+
+func (bw *bannerResponseWriter) finish() {
+	if !bw.hold {
+		return
+	}
+	page := insertBanner(bw.buf.Bytes(), bw.banner)
+	bw.Header().Set("Content-Length", strconv.Itoa(len(page)))
+	bw.ResponseWriter.WriteHeader(http.StatusOK)
+	bw.ResponseWriter.Write(page)
+}
+
+// servesIndex reports whether the frontend answers r with an index.html: for
+// directories, and for any path not in the frontend, which the single page
+// app routes itself.
+func servesIndex(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, "/") || frontendFileError(r.URL.Path) != nil
+}
+
+// checkFrontendIndex verifies that the frontend, and the beta frontend if there
+// is one, have a readable index.html, without which every page fails to load.
+func checkFrontendIndex() {
+	indexes := []string{"/index.html"}
+	if d, err := frontendFS.Open("/beta/"); err == nil {
+		d.Close()
+		indexes = append(indexes, "/beta/index.html")
+	}
+
+	for _, index := range indexes {
+		err := frontendFileError(index)
+		if err == nil {
+			continue
+		}
+		if frontendRequired {
+			log.Fatalln("Frontend index", frontend+index, "is not usable:", err)
+		}
+		log.Warnln("Frontend index", frontend+index, "is not usable:", err)
+	}
+}
+
+// bufferPool is an httputil.BufferPool of fixed size buffers, shared by all
+// reverse proxies so that each proxied response doesn't allocate its own copy
+// buffer.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() interface{} {
+		return make([]byte, p.size)
+	}
+	return p
+}
+
+func (p *bufferPool) Get() []byte {
+	return p.pool.Get().([]byte)
+}
+
+func (p *bufferPool) Put(b []byte) {
+	if cap(b) != p.size {
+		return
+	}
+	p.pool.Put(b[:p.size])
+}
+
+// forwardClientCert replaces any client-supplied clientCertHeader with the
+// subject of the verified client certificate, if there is one.
+func forwardClientCert(proxy *httputil.ReverseProxy) {
+	if clientCertHeader == "" {
+		return
+	}
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Header.Del(clientCertHeader)
+		if cert := clientCert(r); cert != nil {
+			r.Header.Set(clientCertHeader, cert.Subject.String())
+		}
+	}
+}
+
+// headerSize returns the approximate size of h on the wire, along with the
+// size of each header.
+func headerSize(h http.Header) (int, map[string]int) {
+	total, sizes := 0, make(map[string]int, len(h))
+	for k, vs := range h {
+		for _, v := range vs {
+			sizes[k] += len(k) + len(v) + 4
+		}
+		total += sizes[k]
+	}
+	return total, sizes
+}
+
+// logHeaderSizes logs the header sizes of a proxied request and its response
+// when either is over --log-header-size-threshold, or the backend refused the
+// request headers as too large.
+func logHeaderSizes(resp *http.Response) {
+	if headerLogThreshold <= 0 {
+		return
+	}
+	reqTotal, reqSizes := headerSize(resp.Request.Header)
+	respTotal, respSizes := headerSize(resp.Header)
+	if reqTotal <= headerLogThreshold && respTotal <= headerLogThreshold && resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		return
+	}
+	entry := log.WithFields(log.Fields{
+		"path":           resp.Request.URL.Path,
+		"status":         resp.StatusCode,
+		"request_bytes":  reqTotal,
+		"response_bytes": respTotal,
+	})
+	if headerLogNames {
+		entry = entry.WithFields(log.Fields{"request_headers": reqSizes, "response_headers": respSizes})
+	}
+	entry.Infoln("Large proxied headers")
+}
+
+// isEventStream reports whether h describes a Server-Sent Events stream.
+func isEventStream(h http.Header) bool {
+	return strings.HasPrefix(h.Get("Content-Type"), "text/event-stream")
+}
+
+// flushEventStreams makes a per-request proxy pass Server-Sent Events on as
+// they arrive instead of buffering them.
+func flushEventStreams(proxy *httputil.ReverseProxy) {
+	modify := proxy.ModifyResponse
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if isEventStream(resp.Header) {
+			proxy.FlushInterval = -1
+		}
+		if modify != nil {
+			return modify(resp)
+		}
+		return nil
+	}
+}
+
+// newBackendProxy returns a reverse proxy to the given backend using the shared
+// backend Transport. When enabled, responses name the backend that served them,
+// which exposes internal topology and is therefore off by default.
+func newBackendProxy(target *url.URL) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	forwardClientCert(proxy)
+	proxy.Transport = backendTransport
+	if otelEndpoint != "" {
+		proxy.Transport = tracingTransport{backendTransport}
+	}
+	proxy.BufferPool = proxyBuffers
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// Thrift calls should get Thrift back, anything else usually comes from
+		// a proxy or load balancer in front of the backend.
+		ct := resp.Header.Get("Content-Type")
+		if resp.Request.Method == "POST" && resp.StatusCode != http.StatusOK && !strings.Contains(ct, "thrift") && !strings.Contains(ct, "json") {
+			log.Warnf("%v: status %s, content type %q", errNonThriftResponse, resp.Status, ct)
+		}
+		if emitBackendHeader {
+			resp.Header.Set("X-OmniSci-Backend", target.Host)
+		}
+		// Gzip is passed through to clients that accept it. The Transport only
+		// decodes it when it asked for it, so do the same for a backend that
+		// compresses regardless, and when --compress would encode it again.
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			addVary(resp.Header, "Accept-Encoding")
+		}
+		if resp.Header.Get("Content-Encoding") == "gzip" && (compress || !acceptsGzip(resp.Request)) {
+			zr, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				return err
+			}
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{zr, resp.Body}
+			resp.Header.Del("Content-Encoding")
+			resp.Header.Del("Content-Length")
+			resp.ContentLength = -1
+		}
+		if err := markSlowQuery(resp, target); err != nil {
+			return err
+		}
+		logHeaderSizes(resp)
+		return nil
+	}
+	flushEventStreams(proxy)
+	return proxy
+}
+
+// samlSessionScanBytes is how much of a Thrift call is buffered to find the
+// session argument, from --saml-session-scan-bytes.
+var samlSessionScanBytes int
+
+// samlSwapSkips counts the session swaps skipped since samlSwapSkipLogged,
+// the time the last one was logged.
+var (
+	samlSwapSkips      int64
+	samlSwapSkipLogged int64
+)
+
+// logSAMLSwapSkipped logs a skipped session swap. A frontend sending the wrong
+// placeholder does so on every call, so at most one skip a minute is logged,
+// along with how many there were.
+func logSAMLSwapSkipped(r *http.Request, method string) {
+	skipped := atomic.AddInt64(&samlSwapSkips, 1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&samlSwapSkipLogged)
+	if now-last < int64(time.Minute) || !atomic.CompareAndSwapInt64(&samlSwapSkipLogged, last, now) {
+		return
+	}
+	atomic.AddInt64(&samlSwapSkips, -skipped)
+	log.WithFields(log.Fields{
+		"path":    r.URL.Path,
+		"method":  method,
+		"client":  clientIP(r).String(),
+		"skipped": skipped,
+	}).Warnln("SAML session swap skipped: session argument is not a known placeholder")
+}
+
+// samlSessionArgPattern matches the start of a Thrift JSON call whose first
+// argument is a string, capturing that argument, the session ID, still quoted.
+var samlSessionArgPattern = regexp.MustCompile(`^\s*\[\s*1\s*,\s*"(?:[^"\\]|\\.)*"\s*,\s*\d+\s*,\s*\d+\s*,\s*\{\s*"1"\s*:\s*\{\s*"str"\s*:\s*("(?:[^"\\]|\\.)*")`)
+
+// replaceSessionPlaceholder swaps the placeholder session ID in the Thrift call
+// in r's body for sessionID. Thrift writes the session argument first, so only
+// the first --saml-session-scan-bytes of the body are buffered and the rest is
+// streamed through untouched. Any of --saml-placeholder-session-ids is
+// accepted as the placeholder, so frontends using a different one keep
+// working. In general, if the call doesn't look as expected this is a noop,
+// logged when the session argument is there but isn't a known placeholder.
+func replaceSessionPlaceholder(r *http.Request, sessionID string) {
+	body := r.Body
+	prefix := make([]byte, samlSessionScanBytes)
+	n, _ := io.ReadFull(body, prefix)
+	prefix = prefix[:n]
+
+	if loc := samlSessionArgPattern.FindSubmatchIndex(prefix); loc != nil {
+		var current string
+		json.Unmarshal(prefix[loc[2]:loc[3]], &current)
+		if samlPlaceholders[current] {
+			quoted, _ := json.Marshal(sessionID)
+			replaced := make([]byte, 0, len(prefix)+len(quoted))
+			replaced = append(replaced, prefix[:loc[2]]...)
+			replaced = append(replaced, quoted...)
+			replaced = append(replaced, prefix[loc[3]:]...)
+			if r.ContentLength > 0 {
+				r.ContentLength += int64(len(replaced) - len(prefix))
+			}
+			prefix = replaced
+		} else if current != sessionID {
+			logSAMLSwapSkipped(r, thriftMethodName(prefix))
+		}
+	}
+
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), body), body}
+}
+
+// isGRPCWeb reports whether r is a gRPC-Web call.
+func isGRPCWeb(r *http.Request) bool {
+	return r.Method == "POST" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc-web")
+}
+
+// grpcWebTrailers appends the trailers of the gRPC response to its body as a
+// gRPC-Web trailer frame, since browsers can't read HTTP trailers.
+type grpcWebTrailers struct {
+	resp *http.Response
+	body io.ReadCloser
+	tail *bytes.Reader
+}
+
+func (t *grpcWebTrailers) Read(p []byte) (int, error) {
+	if t.tail != nil {
+		return t.tail.Read(p)
+	}
+	n, err := t.body.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+
+	// Trailers are only known once the body has been read
+	var block bytes.Buffer
+	for k, vs := range t.resp.Trailer {
+		for _, v := range vs {
+			block.WriteString(strings.ToLower(k) + ": " + v + "\r\n")
+		}
+	}
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = 0x80
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+	t.tail = bytes.NewReader(append(frame, block.Bytes()...))
+	// Already sent in the frame, so not as HTTP trailers too
+	t.resp.Trailer = nil
+	if n > 0 {
+		return n, nil
+	}
+	return t.tail.Read(p)
+}
+
+func (t *grpcWebTrailers) Close() error {
+	return t.body.Close()
+}
+
+// newGRPCWebProxy returns a proxy translating gRPC-Web calls into gRPC ones to
+// target, over cleartext HTTP/2 for http URLs. Only the binary gRPC-Web
+// encoding is supported, in which messages are framed just as in gRPC.
+func newGRPCWebProxy(target *url.URL) *httputil.ReverseProxy {
+	transport := &http2.Transport{}
+	if target.Scheme == "http" {
+		transport.AllowHTTP = true
+		transport.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		}
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	forwardClientCert(proxy)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		ct := r.Header.Get("Content-Type")
+		r.Header.Set("Content-Type", "application/grpc"+strings.TrimPrefix(ct, "application/grpc-web"))
+		r.Header.Set("Te", "trailers")
+		r.Header.Del("X-Grpc-Web")
+	}
+	proxy.Transport = transport
+	proxy.FlushInterval = -1
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		ct := resp.Header.Get("Content-Type")
+		if strings.HasPrefix(ct, "application/grpc") {
+			resp.Header.Set("Content-Type", "application/grpc-web"+strings.TrimPrefix(ct, "application/grpc"))
+		}
+		// Keeps the trailers from being announced; the Transport sets them
+		// again once the body is read.
+		resp.Trailer = nil
+		resp.Header.Del("Trailer")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Body = &grpcWebTrailers{resp: resp, body: resp.Body}
+		logHeaderSizes(resp)
+		return nil
+	}
+	return proxy
+}
+
+func thriftOrFrontendHandler(rw http.ResponseWriter, r *http.Request) {
+	// Copies of servers.json elsewhere in the frontend tree are hidden too.
+	if disableServersJSON && path.Base(r.URL.Path) == "servers.json" {
+		http.NotFound(rw, r)
+		return
+	}
+
+	if isGRPCWeb(r) {
+		ct := r.Header.Get("Content-Type")
+		switch {
+		case grpcProxy == nil:
+			http.Error(rw, "gRPC-Web is not enabled", http.StatusNotImplemented)
+		case strings.HasPrefix(ct, "application/grpc-web-text"):
+			http.Error(rw, "Unsupported gRPC-Web encoding: "+ct, http.StatusUnsupportedMediaType)
+		default:
+			grpcProxy.ServeHTTP(rw, r)
+		}
+		return
+	}
+
+	fs := ServeIndexOn404FileSystem{frontendFS, ""}
+	h := http.StripPrefix("/", http.FileServer(fs))
+
+	if !proxyAll && r.URL.Path == "/" && (r.Method == "GET" || r.Method == "HEAD") && (statusPage || frontendFileError("/index.html") != nil) {
+		statusPageHandler(rw, r)
+		return
+	}
+
+	target := activeBackend()
+	if target != backendURL {
+		// Sessions from the primary are unknown to the fallback, this lets the
+		// frontend tell why it has to log in again.
+		rw.Header().Set("X-OmniSci-Failover", "fallback")
+	}
+
+	if proxyAll && r.Method != "POST" {
+		h = newBackendProxy(target)
+	}
+
+	if r.Method == "POST" {
+		h = newBackendProxy(target)
+		rw.Header().Del("Access-Control-Allow-Origin")
+
+		// If the thriftSessionCookieName is present, it holds the real session ID, while the Thrift
+		// call is using a placeholder. This code replaces the fake session ID in the Thrift call
+		// with the real one from the cookie.
+		if samlSession, ok := samlSessionID(r); ok {
+			replaceSessionPlaceholder(r, samlSession)
+		}
+	}
+
+	if r.Method == "GET" && (r.URL.Path == "/" || r.URL.Path == "/beta/" || strings.HasSuffix(fs.Filename, ".html")) {
+		rw.Header().Del("Cache-Control")
+		rw.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
+	}
+
+	// ?nocache=1 forces a fresh copy of any frontend file, for debugging.
+	if allowNocacheParam && r.Method == "GET" && len(r.URL.Query().Get("nocache")) > 0 {
+		r.Header.Del("If-Modified-Since")
+		r.Header.Del("If-None-Match")
+		rw.Header().Set("Cache-Control", "no-store")
+	}
+
+	if !proxyAll && r.Method == "GET" && atomic.LoadInt32(&bannerEnabled) != 0 && servesIndex(r) {
+		// A cached copy would keep or lack the banner regardless of the switch
+		r.Header.Del("If-Modified-Since")
+		r.Header.Del("If-None-Match")
+		r.Header.Del("Range")
+		bw := &bannerResponseWriter{ResponseWriter: rw, banner: bannerHTML.Load().(string)}
+		h.ServeHTTP(bw, r)
+		bw.finish()
+		return
+	}
+
+	h.ServeHTTP(rw, r)
+}
+
+func betaOrRedirectFrontendHandler(rw http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(betaCookieName)
+	if betaRequireCookie && (err != nil || cookie.Value != "true") {
+		http.Redirect(rw, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	thriftOrFrontendHandler(rw, r)
+}
+
+// betaOptInHandler sets the beta cookie and sends the user to the beta frontend.
+func betaOptInHandler(rw http.ResponseWriter, r *http.Request) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     betaCookieName,
+		Value:    "true",
+		Path:     "/",
+		MaxAge:   int(betaCookieMaxAge / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(rw, r, "/beta/", http.StatusSeeOther)
+}
+
+// betaOptOutHandler clears the beta cookie and sends the user to the regular
+// frontend.
+func betaOptOutHandler(rw http.ResponseWriter, r *http.Request) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     betaCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(rw, r, "/", http.StatusSeeOther)
+}
+
+func httpToHTTPSRedirectHandler(rw http.ResponseWriter, r *http.Request) {
+	// Redirect HTTP request to same URL with only two changes: https scheme,
+	// and the main server port configured in the 'port' param, rather than the
+	// incoming port ('http-to-https-redirect-port')
+	requestHost, _, _ := net.SplitHostPort(r.Host)
+	redirectURL := url.URL{Scheme: "https", Host: requestHost + ":" + strconv.Itoa(port), Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	http.Redirect(rw, r, redirectURL.String(), http.StatusTemporaryRedirect)
+}
+
+func (sm *staticMount) staticHandler(rw http.ResponseWriter, r *http.Request) {
+	var fs http.FileSystem = http.Dir(sm.Dir)
+	if sm.SPA {
+		fs = ServeIndexOn404FileSystem{fs, ""}
+	}
+	h := http.StripPrefix(strings.TrimSuffix(sm.Path, "/"), http.FileServer(fs))
+	h.ServeHTTP(rw, r)
+}
+
+func (rp *reverseProxy) proxyHandler(rw http.ResponseWriter, r *http.Request) {
+	proxy := httputil.NewSingleHostReverseProxy(rp.Target)
+	proxy.BufferPool = proxyBuffers
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		logHeaderSizes(resp)
+		return nil
+	}
+	if otelEndpoint != "" {
+		proxy.Transport = tracingTransport{http.DefaultTransport}
+	}
+	forwardClientCert(proxy)
+	flushEventStreams(proxy)
+	h := http.StripPrefix(rp.Path, proxy)
+	h.ServeHTTP(rw, r)
+}
+
+// countingResponseWriter is an http.ResponseWriter that records the status and
+// number of bytes of the response.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *countingResponseWriter) WriteHeader(c int) {
+	w.status = c
+	w.ResponseWriter.WriteHeader(c)
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func downloadsHandler(rw http.ResponseWriter, r *http.Request) {
+	if r.RequestURI == "/downloads/" {
+		rw.Write([]byte(""))
+		return
+	}
+	cw := &countingResponseWriter{ResponseWriter: rw}
+	h := http.StripPrefix("/downloads/", http.FileServer(http.Dir(dataDir+"/mapd_export/")))
+	h.ServeHTTP(cw, r)
+
+	if cw.status >= http.StatusBadRequest {
+		markMeter("download.failures", 1)
+		return
+	}
+	markMeter("download.count", 1)
+	markMeter("download.bytes", cw.bytes)
+
+	// Frequent range requests mean clients are resuming interrupted downloads.
+	if cw.status == http.StatusPartialContent {
+		markMeter("download.range.count", 1)
+		markMeter("download.range.bytes", cw.bytes)
+	} else {
+		markMeter("download.full.count", 1)
+		markMeter("download.full.bytes", cw.bytes)
+	}
+}
+
+func modifyServersJSON(r *http.Request, orig []byte) ([]byte, error) {
+	session, _ := sessionStore.Get(r, "servers-json")
+	j, err := gabs.ParseJSON(orig)
+	if err != nil {
+		return nil, err
+	}
+
+	jj, err := j.Children()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range serversJSONParams {
+		if session.Values[key] != nil {
+			_, err = jj[0].Set(session.Values[key].(string), key)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return j.BytesIndent("", "  "), nil
+}
+
+// hasServersJSONOverrides reports whether the request's session holds any
+// values to inject into servers.json.
+func hasServersJSONOverrides(r *http.Request) bool {
+	session, _ := sessionStore.Get(r, "servers-json")
+	for _, key := range serversJSONParams {
+		if session.Values[key] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// serversJSONDoc is a servers.json file as read from disk, along with its
+// unmodified rendering. It is valid for as long as the file's modification time
+// and size are unchanged.
+type serversJSONDoc struct {
+	modTime  time.Time
+	size     int64
+	raw      []byte
+	indented []byte
+	err      error
+}
+
+// serversJSONRead is an in-flight read of a servers.json file, shared by all
+// requests for the same file that arrive while it is running.
+type serversJSONRead struct {
+	wg  sync.WaitGroup
+	doc *serversJSONDoc
+	err error
+}
+
+var (
+	serversJSONMutex sync.Mutex
+	serversJSONDocs  = make(map[string]*serversJSONDoc)
+	serversJSONReads = make(map[string]*serversJSONRead)
+)
+
+// readServersJSON returns the parsed servers.json at path, reading it from disk
+// only when it has changed. Concurrent reads of the same file are coalesced
+// into one.
+func readServersJSON(path string) (*serversJSONDoc, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	serversJSONMutex.Lock()
+	if doc, ok := serversJSONDocs[path]; ok && doc.modTime.Equal(fi.ModTime()) && doc.size == fi.Size() {
+		serversJSONMutex.Unlock()
+		return doc, nil
+	}
+	if rd, ok := serversJSONReads[path]; ok {
+		serversJSONMutex.Unlock()
+		rd.wg.Wait()
+		return rd.doc, rd.err
+	}
+	rd := &serversJSONRead{}
+	rd.wg.Add(1)
+	serversJSONReads[path] = rd
+	serversJSONMutex.Unlock()
+
+	raw, err := ioutil.ReadFile(path)
+	if err == nil {
+		doc := &serversJSONDoc{modTime: fi.ModTime(), size: fi.Size(), raw: raw}
+		j, perr := gabs.ParseJSON(raw)
+		if perr == nil {
+			doc.indented = j.BytesIndent("", "  ")
 		}
+		doc.err = perr
+		rd.doc = doc
 	}
-	return false
+	rd.err = err
+
+	serversJSONMutex.Lock()
+	delete(serversJSONReads, path)
+	if rd.doc != nil {
+		serversJSONDocs[path] = rd.doc
+	}
+	serversJSONMutex.Unlock()
+	rd.wg.Done()
+
+	return rd.doc, rd.err
 }
 
-// thriftTimingHandler records timings for all Thrift method calls. It also
-// records timings reported by the backend, as defined by ThriftMethodMap.
-// TODO(andrew): use proper Thrift-generated parser
-func thriftTimingHandler(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/" && hasCustomServersJSONParams(r) {
-			setServersJSONHandler(rw, r)
-			http.Redirect(rw, r, r.URL.Path, http.StatusSeeOther)
-			return
+// newSessionStore returns the store of the servers.json session, whose cookie
+// lasts maxAge, or until the browser closes if that is 0.
+func newSessionStore(hashKey, encKey []byte, maxAge time.Duration) *sessions.CookieStore {
+	store := sessions.NewCookieStore(hashKey, encKey)
+	store.MaxAge(int(maxAge / time.Second))
+	// The cookie size is checked by saveServersJSONParams, which also accounts
+	// for the cookie name.
+	for _, codec := range store.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxLength(0)
 		}
+	}
+	return store
+}
 
-		if !enableMetrics || r.Method != "POST" || (r.Method == "POST" && r.URL.Path != "/") {
-			h.ServeHTTP(rw, r)
-			return
+func serversHandler(rw http.ResponseWriter, r *http.Request) {
+	if disableServersJSON {
+		http.NotFound(rw, r)
+		return
+	}
+
+	var j, jj []byte
+	servers := ""
+	subDir := filepath.Dir(r.URL.Path)
+	if len(serversJSON) > 0 {
+		servers = serversJSON
+	} else {
+		servers = frontend + subDir + "/servers.json"
+		if _, err := os.Stat(servers); os.IsNotExist(err) {
+			servers = frontend + "/servers.json"
+		}
+	}
+	// The first matching rule overrides the default
+	for _, sr := range serversJSONRules {
+		if sr.matches(r) {
+			servers = sr.File
+			break
 		}
+	}
+	doc, err := readServersJSON(servers)
+	if err != nil {
+		s := server{}
+		s.Master = true
+		s.Username = "admin"
+		s.Password = "HyperInteractive"
+		s.Database = "omnisci"
 
-		var thriftMethod string
-		body, _ := ioutil.ReadAll(r.Body)
-		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h, p, _ := net.SplitHostPort(r.Host)
+		s.Port, _ = net.LookupPort("tcp", p)
+		s.Host = h
+		// handle IPv6 addresses
+		ip := net.ParseIP(h)
+		if ip != nil && ip.To4() == nil {
+			s.Host = "[" + h + "]"
+		}
+
+		ss := []server{s}
+		j, _ = json.Marshal(ss)
+		jj, err = modifyServersJSON(r, j)
+	} else if hasServersJSONOverrides(r) {
+		// Per-session modifications need a private copy of the document
+		jj, err = modifyServersJSON(r, doc.raw)
+	} else {
+		jj, err = doc.indented, doc.err
+	}
+	if err != nil {
+		msg := "Error processing servers.json: " + err.Error()
+		http.Error(rw, msg, http.StatusInternalServerError)
+		log.Println(msg)
+		return
+	}
+
+	rw.Header().Del("Cache-Control")
+	rw.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
+	// The document is modified per session
+	addVary(rw.Header(), "Cookie")
+	writeCompressed(rw, r, "application/json", jj)
+}
+
+// internalNotFoundHandler answers requests for unknown /_internal/ endpoints,
+// which would otherwise get the frontend's index.html.
+func internalNotFoundHandler(rw http.ResponseWriter, r *http.Request) {
+	j, _ := json.Marshal(map[string]string{"error": "unknown internal endpoint: " + r.URL.Path})
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusNotFound)
+	rw.Write(j)
+}
 
-		elems := strings.SplitN(string(body), ",", 3)
-		if len(elems) > 1 {
-			thriftMethod = strings.Trim(elems[1], `"`)
+// acceptsGzip reports whether the client accepts gzip encoded responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, p := range parts[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) != 2 || !strings.EqualFold(kv[0], "q") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err != nil || q <= 0 {
+				return false
+			}
 		}
+		return true
+	}
+	return false
+}
 
-		if len(thriftMethod) < 1 {
-			h.ServeHTTP(rw, r)
-			return
+// addVary adds fields to the Vary header of h, skipping any already listed.
+func addVary(h http.Header, fields ...string) {
+	for _, f := range fields {
+		listed := false
+		for _, v := range h["Vary"] {
+			for _, name := range strings.Split(v, ",") {
+				if n := strings.TrimSpace(name); n == "*" || strings.EqualFold(n, f) {
+					listed = true
+				}
+			}
 		}
+		if !listed {
+			h.Add("Vary", f)
+		}
+	}
+}
 
-		tm, exists := thriftMethodMap[thriftMethod]
-		defer recordTimingDuration("all", time.Now())
-		defer recordTimingDuration(thriftMethod, time.Now())
+// writeCompressed writes a small response body, gzipped if the client accepts
+// it. With --compress the whole response is compressed later on, so the body is
+// written as is. Either way the response depends on Accept-Encoding, and says
+// so, so that caches in front of the server don't mix up the encodings.
+func writeCompressed(rw http.ResponseWriter, r *http.Request, contentType string, body []byte) {
+	rw.Header().Set("Content-Type", contentType)
+	addVary(rw.Header(), "Accept-Encoding")
+	if compress || !acceptsGzip(r) {
+		rw.Write(body)
+		return
+	}
 
-		if !exists {
-			h.ServeHTTP(rw, r)
-			return
+	rw.Header().Set("Content-Encoding", "gzip")
+	gw := gzip.NewWriter(rw)
+	gw.Write(body)
+	gw.Close()
+}
+
+var (
+	versionMutex   sync.Mutex
+	versionModTime time.Time
+	versionSize    int64
+	versionLoaded  bool
+	versionImmerse []byte
+)
+
+// immerseVersion returns the contents of the frontend's version.txt, or nil if
+// there is none. The file is only reread when its modification time or size
+// changes.
+func immerseVersion() []byte {
+	versTxt := frontend + "/version.txt"
+	fi, statErr := os.Stat(versTxt)
+
+	versionMutex.Lock()
+	defer versionMutex.Unlock()
+
+	if versionLoaded && statErr == nil && fi.ModTime().Equal(versionModTime) && fi.Size() == versionSize {
+		return versionImmerse
+	}
+	if versionLoaded && statErr != nil && versionModTime.IsZero() {
+		return versionImmerse
+	}
+
+	feVers, err := ioutil.ReadFile(versTxt)
+	versionModTime, versionSize, versionImmerse = time.Time{}, 0, nil
+	if statErr == nil && err == nil {
+		versionModTime, versionSize, versionImmerse = fi.ModTime(), fi.Size(), feVers
+	}
+	versionLoaded = true
+	return versionImmerse
+}
+
+// versionInfo is the JSON form of /version. ImmerseStatus tells a missing
+// version.txt ("unknown") apart from a missing frontend ("not-deployed").
+type versionInfo struct {
+	OmniSciDB     string `json:"omniscidb"`
+	Immerse       string `json:"immerse"`
+	ImmerseStatus string `json:"immerse_status"`
+}
+
+func versionHandler(rw http.ResponseWriter, r *http.Request) {
+	vi := versionInfo{OmniSciDB: version, Immerse: "unknown", ImmerseStatus: "ok"}
+	if feVers := immerseVersion(); feVers != nil {
+		vi.Immerse = strings.TrimSpace(string(feVers))
+	} else if frontendFileError("/index.html") != nil {
+		vi.ImmerseStatus = "not-deployed"
+	} else {
+		vi.ImmerseStatus = "unknown"
+	}
+	if vi.OmniSciDB == "" {
+		vi.OmniSciDB = "unknown"
+	}
+
+	addVary(rw.Header(), "Accept")
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		j, _ := json.Marshal(vi)
+		writeCompressed(rw, r, "application/json", j)
+		return
+	}
+	writeCompressed(rw, r, "text/plain; charset=utf-8", []byte("OmniSciDB:\n"+vi.OmniSciDB+"\n\nImmerse:\n"+vi.Immerse))
+}
+
+// pingResult holds the outcome of a round-trip get_server_status call to the
+// backend, as reported by /ping.
+type pingResult struct {
+	Status    string    `json:"status"`
+	LatencyMs float64   `json:"latency_ms"`
+	Version   string    `json:"version,omitempty"`
+	Edition   string    `json:"edition,omitempty"`
+	ReadOnly  bool      `json:"read_only"`
+	Error     string    `json:"error,omitempty"`
+	Checked   time.Time `json:"checked"`
+}
+
+var (
+	pingMutex  sync.Mutex
+	pingCached *pingResult
+)
+
+// pingBackend makes a minimal Thrift call to the backend and measures how long
+// it takes to get a response.
+func pingBackend(timeout time.Duration) *pingResult {
+	res := &pingResult{Status: "ok", Checked: time.Now()}
+
+	// get_server_status does not require a valid session, so an empty one is
+	// enough to exercise the full backend path.
+	var jsonString = []byte(`[1,"get_server_status",1,0,{"1":{"str":""}}]`)
+
+	then := time.Now()
+	client := &http.Client{Transport: backendTransport, Timeout: timeout}
+	resp, err := client.Post(backendURL.String(), "application/vnd.apache.thrift.json", bytes.NewBuffer(jsonString))
+	if err != nil {
+		res.Status = "error"
+		res.Error = err.Error()
+		return res
+	}
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	res.LatencyMs = float64(time.Since(then)) / float64(time.Millisecond)
+	if err != nil {
+		res.Status = "error"
+		res.Error = err.Error()
+		return res
+	}
+	if resp.StatusCode != http.StatusOK {
+		res.Status = "error"
+		res.Error = "backend returned " + resp.Status
+		return res
+	}
+
+	jsonParsed, err := gabs.ParseJSON(bodyBytes)
+	if err != nil {
+		res.Status = "error"
+		res.Error = "could not parse backend response: " + err.Error()
+		return res
+	}
+
+	// Success => [1,"get_server_status",2,0,{"0":{"rec":{"1":{"tf":0},"2":{"str":"4.5.0"},...}}}]
+	// Failure => [1,"get_server_status",2,0,{"1":{"rec":{"1":{"str":"..."}}}}]
+	status := jsonParsed.Index(4).Search("0", "rec")
+	if status.Data() == nil {
+		res.Status = "error"
+		res.Error, _ = jsonParsed.Index(4).Search("1", "rec", "1", "str").Data().(string)
+		if res.Error == "" {
+			res.Error = "unexpected backend response"
 		}
+		return res
+	}
+	readOnly, _ := status.Search("1", "tf").Data().(float64)
+	res.ReadOnly = readOnly != 0
+	res.Version, _ = status.Search("2", "str").Data().(string)
+	res.Edition, _ = status.Search("5", "str").Data().(string)
 
-		buf := new(bytes.Buffer)
-		mw := io.MultiWriter(buf, rw)
+	return res
+}
 
-		rw = &ResponseMultiWriter{
-			Writer:         mw,
-			ResponseWriter: rw,
+// pingHandler reports backend status and round-trip latency. Results are cached
+// for pingCacheTTL so that aggressive monitors do not hammer the backend.
+func pingHandler(rw http.ResponseWriter, r *http.Request) {
+	pingMutex.Lock()
+	res := pingCached
+	if res == nil || time.Since(res.Checked) >= pingCacheTTL {
+		res = pingBackend(5 * time.Second)
+		pingCached = res
+	}
+	pingMutex.Unlock()
+
+	j, _ := json.Marshal(res)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if res.Status != "ok" {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	rw.Write(j)
+}
+
+// backendHealth is the most recent result of probing a health check target.
+type backendHealth struct {
+	Target    string    `json:"target"`
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMs float64   `json:"latency_ms"`
+	Checked   time.Time `json:"checked"`
+}
+
+// healthTarget is a server checked by the health checker. Only one probe of a
+// target runs at a time.
+type healthTarget struct {
+	name    string
+	probe   func() error
+	running int32
+}
+
+var (
+	healthTargets []*healthTarget
+	healthMutex   sync.RWMutex
+	healthResults = make(map[string]*backendHealth)
+	// healthProbes counts the probes started by checkAllHealth that are still
+	// running.
+	healthProbes sync.WaitGroup
+)
+
+// probeWritable checks that a file can be written to dir.
+func probeWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".omnisci_web_server_probe")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write([]byte("ok"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// dialURL checks that a TCP connection can be made to the server at u.
+func dialURL(u *url.URL) error {
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
 		}
+	}
+	conn, err := net.DialTimeout("tcp", host, healthCheckTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
 
-		h.ServeHTTP(rw, r)
+// probeBackend reports whether the backend is serving, using the probe selected
+// by --backend-health-method.
+func probeBackend() error {
+	switch backendHealthMethod {
+	case "TCP":
+		return dialURL(backendURL)
+	case "THRIFT":
+		res := pingBackend(healthCheckTimeout)
+		if res.Status != "ok" {
+			return errors.New(res.Error)
+		}
+		return nil
+	}
 
-		go func() {
-			offset := strings.LastIndex(buf.String(), tm.Start)
-			if offset >= 0 {
-				timings := tm.Regex.FindAllStringSubmatch(buf.String()[offset:], len(tm.Labels))
-				for k, v := range timings {
-					dur, _ := time.ParseDuration(v[1] + tm.Units)
-					recordTiming(thriftMethod+"."+tm.Labels[k], dur)
+	probeURL := backendURL.ResolveReference(&url.URL{Path: backendHealthPath})
+	req, err := http.NewRequest(backendHealthMethod, probeURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: backendTransport, Timeout: healthCheckTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("backend returned " + resp.Status)
+	}
+	return nil
+}
+
+// awaitBackend polls the backend with the health probe until it responds or
+// waitForBackend passes, logging while it waits. It then refreshes the
+// backend's health result.
+func awaitBackend() {
+	deadline := time.Now().Add(waitForBackend)
+	for {
+		err := probeBackend()
+		if err == nil {
+			log.Infoln("Backend is up")
+			// Don't leave /ready reporting an earlier failure until the next check
+			for _, t := range healthTargets {
+				if t.name == "backend" {
+					checkHealth(t)
 				}
 			}
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Warnf("Backend still unreachable after %v, starting anyway: %v", waitForBackend, err)
+			return
+		}
+		log.Infoln("Waiting for backend:", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// warmBackend fills the backend connection pool with warmupConnections
+// connections, by making that many concurrent pings, so that the first users
+// don't wait for connections to be set up. Warmup starts once the backend is
+// first reported up, and /ready reports not ready until it is done, whether or
+// not the pings succeed.
+func warmBackend() {
+	defer atomic.StoreInt32(&warmingUp, 0)
+
+	for res := healthResult("backend"); res == nil || !res.Healthy; res = healthResult("backend") {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	var wg sync.WaitGroup
+	var warmed int32
+	for i := 0; i < warmupConnections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res := pingBackend(healthCheckTimeout); res.Status == "ok" {
+				atomic.AddInt32(&warmed, 1)
+			}
 		}()
-	})
+	}
+	wg.Wait()
+	log.Infoln("Warmed up", warmed, "of", warmupConnections, "backend connections")
 }
 
-func metricsHandler(rw http.ResponseWriter, r *http.Request) {
-	if len(r.FormValue("enable")) > 0 {
-		enableMetrics = true
-	} else if len(r.FormValue("disable")) > 0 {
-		enableMetrics = false
+// activeBackend returns the backend requests should go to: the fallback
+// backend while the primary is reported down and the fallback is not,
+// otherwise the primary.
+func activeBackend() *url.URL {
+	if fallbackBackendURL == nil {
+		return backendURL
 	}
-	jsonBuf := new(bytes.Buffer)
-	metrics.WriteJSONOnce(registry, jsonBuf)
-	ijsonBuf := new(bytes.Buffer)
-	json.Indent(ijsonBuf, jsonBuf.Bytes(), "", "  ")
-	rw.Write(ijsonBuf.Bytes())
+	if res := healthResult("backend"); res == nil || res.Healthy {
+		return backendURL
+	}
+	if res := healthResult("fallback"); res == nil || !res.Healthy {
+		return backendURL
+	}
+	markMeter("backend.failover", 1)
+	return fallbackBackendURL
 }
 
-func metricsResetHandler(rw http.ResponseWriter, r *http.Request) {
-	registry.UnregisterAll()
-	metricsHandler(rw, r)
+// healthResult returns the cached result for the named target, or nil if it
+// has not been checked yet.
+func healthResult(name string) *backendHealth {
+	healthMutex.RLock()
+	defer healthMutex.RUnlock()
+	return healthResults[name]
 }
 
-func setServersJSONHandler(rw http.ResponseWriter, r *http.Request) {
-	session, _ := sessionStore.Get(r, "servers-json")
+// checkHealth probes t and caches the result, logging whenever the target goes
+// up or down. It returns immediately if a previous probe of t is still running.
+func checkHealth(t *healthTarget) {
+	if !atomic.CompareAndSwapInt32(&t.running, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&t.running, 0)
 
-	for _, key := range serversJSONParams {
-		if len(r.FormValue(key)) > 0 {
-			session.Values[key] = r.FormValue(key)
+	then := time.Now()
+	res := &backendHealth{Target: t.name, Healthy: true, Checked: then}
+	if err := t.probe(); err != nil {
+		res.Healthy = false
+		res.Error = err.Error()
+	}
+	res.LatencyMs = float64(time.Since(then)) / float64(time.Millisecond)
+
+	healthMutex.Lock()
+	prev := healthResults[t.name]
+	healthResults[t.name] = res
+	healthMutex.Unlock()
+
+	if enableMetrics {
+		var up int64
+		if res.Healthy {
+			up = 1
 		}
+		g := registry.GetOrRegister("backend_up."+t.name, metrics.NewGauge)
+		g.(metrics.Gauge).Update(up)
 	}
 
-	session.Save(r, rw)
+	if prev == nil || prev.Healthy != res.Healthy {
+		if res.Healthy {
+			log.Infoln("Health check target", t.name, "is up")
+		} else {
+			log.Warnln("Health check target", t.name, "is down:", res.Error)
+		}
+	}
 }
 
-func clearServersJSONHandler(rw http.ResponseWriter, r *http.Request) {
-	session, _ := sessionStore.Get(r, "servers-json")
-
-	session.Options.MaxAge = -1
+// checkAllHealth starts a probe of every health target. They run concurrently,
+// so that a slow target does not delay the others.
+func checkAllHealth() {
+	for _, t := range healthTargets {
+		healthProbes.Add(1)
+		go func(t *healthTarget) {
+			defer healthProbes.Done()
+			checkHealth(t)
+		}(t)
+	}
+}
 
-	session.Save(r, rw)
+// watchHealth probes the backend and the reverse proxy targets every
+// healthCheckInterval.
+func watchHealth() {
+	for {
+		checkAllHealth()
+		time.Sleep(healthCheckInterval)
+	}
 }
 
-func docsHandler(rw http.ResponseWriter, r *http.Request) {
-	h := http.StripPrefix("/docs/", http.FileServer(http.Dir(docsDir)))
-	h.ServeHTTP(rw, r)
+// healthBackendsHandler lists the cached health of every target.
+func healthBackendsHandler(rw http.ResponseWriter, r *http.Request) {
+	healthMutex.RLock()
+	out := make([]*backendHealth, 0, len(healthTargets))
+	for _, t := range healthTargets {
+		if res := healthResults[t.name]; res != nil {
+			out = append(out, res)
+		}
+	}
+	healthMutex.RUnlock()
+
+	j, _ := json.MarshalIndent(out, "", "  ")
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	rw.Write(j)
 }
 
-// samlPostHandler receives a XML SAML payload from a provider (e.g. Okta) and
-// then makes a connect call to OmniSciDB with the base64'd payload. If the call succeeds
-// we then set a session cookie (`omnisci_session`) for Immerse to use for login, as well
-// as the username (`omnisci_username`) and db name (`omnisci_db`).
-func samlPostHandler(rw http.ResponseWriter, r *http.Request) {
-	var err error
-	ok := false
-	targetPage := "/"
+var statusPageTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>OmniSci Web Server</title></head>
+<body>
+<h1>OmniSci Web Server</h1>
+<p>Version {{or .Version "unknown"}}</p>
+{{with .Backend}}<p>Backend {{if .Healthy}}reachable{{else}}unreachable{{end}}, checked {{.Checked.Format "2006-01-02 15:04:05 MST"}}</p>
+{{else}}<p>Backend not checked yet</p>
+{{end}}<ul>
+<li><a href="/health">/health</a></li>
+<li><a href="/ready">/ready</a></li>
+{{if .Metrics}}<li><a href="/metrics/">/metrics/</a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
 
-	if r.Method == "POST" {
-		var sessionToken string
+// statusPageHandler serves a small status page in place of the frontend, for
+// deployments without one. The page is public, so why the backend is
+// unreachable, which can name internal hosts, only goes to the log.
+func statusPageHandler(rw http.ResponseWriter, r *http.Request) {
+	res := healthResult("backend")
+	if res != nil && !res.Healthy {
+		log.WithField("client", clientIP(r).String()).Warnln("Status page shows backend unreachable:", res.Error)
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	statusPageTemplate.Execute(rw, struct {
+		Version string
+		Backend *backendHealth
+		Metrics bool
+	}{version, res, enableMetrics && !separateAdmin})
+}
 
-		b64ResponseXML := r.FormValue("SAMLResponse")
+// healthHandler reports that the web server process is alive.
+func healthHandler(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	rw.Write([]byte("{\"status\": \"ok\"}\n"))
+}
 
-		// This is what a Thrift connect call to OmniSciDB looks like. Here, the username and database
-		// name are left blank, per SAML login conventions. Hand-crafting Thrift messages like this
-		// isn't exactly "best practices", but it beats importing a whole Thrift lib for just this.
-		var jsonString = []byte(`[1,"connect",1,0,{"2":{"str":"` + b64ResponseXML + `"},"3":{"str":""}}]`)
+// parseUnreadyBody parses a --readyz-unready-body template, which may quote
+// values with {{json ...}}.
+func parseUnreadyBody(t string) (*texttemplate.Template, error) {
+	return texttemplate.New("unready").Funcs(texttemplate.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			j, err := json.Marshal(v)
+			return string(j), err
+		},
+	}).Parse(t)
+}
 
-		resp, err := http.Post(backendURL.String(), "application/vnd.apache.thrift.json", bytes.NewBuffer(jsonString))
-		if err != nil {
-			return
+// readyHandler reports whether the backend is serving, as last seen by the
+// health checker, failing with --readyz-unready-status when it is not or the
+// server is shutting down.
+func readyHandler(rw http.ResponseWriter, r *http.Request) {
+	res := healthResult("backend")
+	if res == nil {
+		res = &backendHealth{Target: "backend", Error: "backend not checked yet"}
+	}
+	// Still able to serve queries while failed over
+	if fb := healthResult("fallback"); !res.Healthy && fb != nil && fb.Healthy {
+		res = fb
+	}
+	// Uploads and logs fail without a writable disk, even with the backend up
+	if res.Healthy {
+		for _, t := range healthTargets {
+			if d := healthResult(t.name); strings.HasPrefix(t.name, "disk:") && d != nil && !d.Healthy {
+				res = d
+				break
+			}
+		}
+	}
+	if atomic.LoadInt32(&warmingUp) != 0 {
+		res = &backendHealth{Target: "backend", Error: "warming up backend connections", Checked: res.Checked}
+	}
+	if atomic.LoadInt32(&draining) != 0 {
+		res = &backendHealth{Target: res.Target, Error: "shutting down", Checked: res.Checked}
+	}
+	j, _ := json.Marshal(res)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if res.Healthy {
+		rw.Write(j)
+		return
+	}
+	if unreadyBody != nil {
+		var buf bytes.Buffer
+		if err := unreadyBody.Execute(&buf, res); err != nil {
+			log.Warnln("Error rendering unready body:", err)
+		} else {
+			j = buf.Bytes()
 		}
+	}
+	rw.WriteHeader(unreadyStatus)
+	rw.Write(j)
+}
 
-		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
+// caFiles returns the CA certificate files listed in paths, a comma separated
+// list in which each entry may be either a single file or a directory of them.
+func caFiles(paths string) ([]string, error) {
+	var files []string
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
 
-		jsonParsed, _ := gabs.ParseJSON(bodyBytes)
+		fi, err := os.Stat(path)
 		if err != nil {
-			return
+			return nil, err
 		}
-
-		relayState := r.FormValue("RelayState")
-		if relayState != "" {
-			targetPage = relayState
+		if !fi.IsDir() {
+			files = append(files, path)
+			continue
 		}
 
-		// We should have one of the two following payloads at this point:
-		// 		Success => [1,"connect",2,0,{"0":{"str":"5h6KW9NTv1ef1kOfOlAGN9q63usKOg0i"}}]
-		// 		Failure => [1,"connect",2,0,{"1":{"rec":{"1":{"str":"Invalid credentials."}}}}]
-		// Only set the cookie if we can parse a success payload.
-		sessionToken, ok = jsonParsed.Index(4).Search("0", "str").Data().(string)
-		if ok {
-			sessionIDCookie := http.Cookie{
-				Name:     thriftSessionCookieName,
-				Value:    sessionToken,
-				HttpOnly: true,
-			}
-			http.SetCookie(rw, &sessionIDCookie)
-
-			samlFlagCookie := http.Cookie{
-				Name:  samlAuthCookieName,
-				Value: "true",
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+				files = append(files, filepath.Join(path, e.Name()))
 			}
-			http.SetCookie(rw, &samlFlagCookie)
 		}
 	}
+	return files, nil
+}
 
-	defer func() {
-		if ok {
-			http.Redirect(rw, r, targetPage, 301)
-		} else {
-			var errorString string
+// loadCACertPool builds a certificate pool from the PEM encoded CA certificates
+// in the files and directories listed in path. Every file must contain at least
+// one valid certificate.
+func loadCACertPool(path string) (*x509.CertPool, int, error) {
+	files, err := caFiles(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	pool := x509.NewCertPool()
+	count := 0
+	for _, f := range files {
+		rest, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, 0, err
+		}
+		n := 0
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
 			if err != nil {
-				errorString = err.Error()
-			} else {
-				errorString = "invalid credentials"
+				return nil, 0, errors.New("could not parse certificate in " + f + ": " + err.Error())
 			}
-			http.Redirect(rw, r, samlErrorPage, 303)
-			log.Infoln("Error logging user in via SAML: ", errorString)
+			pool.AddCert(cert)
+			n++
 		}
-	}()
-}
-
-type ServeIndexOn404FileSystem struct {
-	http.FileSystem
-	Filename string
-}
-
-func (fs ServeIndexOn404FileSystem) Open(name string) (http.File, error) {
-	file, err := fs.FileSystem.Open(name)
-	if os.IsNotExist(err) {
-		if strings.HasPrefix(name, "/beta/") {
-			file, err = fs.FileSystem.Open("/beta/index.html")
-		} else {
-			file, err = fs.FileSystem.Open("/index.html")
+		if n == 0 {
+			return nil, 0, errors.New("no certificates found in " + f)
 		}
+		count += n
+	}
+	if count == 0 {
+		return nil, 0, errors.New("no certificates found in " + path)
 	}
+	return pool, count, nil
+}
 
+// caFilesVersion summarizes the modification state of the CA certificate files
+// at path, so that changes can be detected.
+func caFilesVersion(path string) string {
+	files, err := caFiles(path)
 	if err != nil {
-		if stat, statErr := file.Stat(); statErr != nil {
-			fs.Filename = stat.Name()
+		return err.Error()
+	}
+	var v string
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			v += f + ":" + fi.ModTime().String() + ":" + strconv.FormatInt(fi.Size(), 10) + ";"
 		}
 	}
-
-	return file, err
+	return v
 }
 
-func thriftOrFrontendHandler(rw http.ResponseWriter, r *http.Request) {
-	fs := ServeIndexOn404FileSystem{http.Dir(frontend), ""}
-	h := http.StripPrefix("/", http.FileServer(fs))
-
-	if r.Method == "POST" {
-		h = httputil.NewSingleHostReverseProxy(backendURL)
-		rw.Header().Del("Access-Control-Allow-Origin")
+// watchPeerCerts reloads the peer CA certificate pool whenever the files change.
+// A pool that fails to load is logged and the previous one is kept.
+func watchPeerCerts(pool *atomic.Value) {
+	last := caFilesVersion(peerCertFile)
+	for range time.Tick(peerCertReload) {
+		v := caFilesVersion(peerCertFile)
+		if v == last {
+			continue
+		}
+		last = v
 
-		// If the thriftSessionCookieName is present, it holds the real session ID, while the Thrift
-		// call is using a placeholder. This code replaces the fake session ID in the Thrift call
-		// with the real one from the cookie.
-		samlAuthCookie, samlAuthCookieErr := r.Cookie(samlAuthCookieName)
-		sessionIDCookie, sessionIDCookieErr := r.Cookie(thriftSessionCookieName)
-		if samlAuthCookieErr == nil && sessionIDCookieErr == nil && samlAuthCookie.Value == "true" && sessionIDCookie != nil {
-			bodyBytes, _ := ioutil.ReadAll(r.Body)
-			defer r.Body.Close()
-
-			// In general, if we encounter any errors, we want to make this session code a noop
-			jsonParsed, err := gabs.ParseJSON(bodyBytes)
-			if err == nil {
-				// Grab the session ID from the thrift call
-				sessionToken, ok := jsonParsed.Index(4).Search("1", "str").Data().(string)
-
-				// If the session ID is our known placeholder ID, replace it with the real one
-				if ok && sessionToken == samlPlaceholderSessionID {
-					jsonParsed.Index(4).Set(sessionIDCookie.Value, "1", "str")
-
-					r.Body = ioutil.NopCloser(bytes.NewReader([]byte(jsonParsed.String())))
-					r.ContentLength = int64(len(jsonParsed.String()))
-				} else {
-					r.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
-				}
-			} else {
-				r.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
-			}
+		caCertPool, n, err := loadCACertPool(peerCertFile)
+		if err != nil {
+			log.Errorln("Error reloading peer certificates, keeping previous ones:", err)
+			continue
 		}
+		pool.Store(caCertPool)
+		log.Infoln("Reloaded", n, "peer CA certificates from", peerCertFile)
 	}
+}
 
-	if r.Method == "GET" && (r.URL.Path == "/" || r.URL.Path == "/beta/" || strings.HasSuffix(fs.Filename, ".html")) {
-		rw.Header().Del("Cache-Control")
-		rw.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
+// clientAuthTLSConfig returns a copy of base that asks for client certificates
+// per --https-client-auth-mode and verifies them against the CA pool in
+// clientCAs. The current pool is handed out on every handshake, so reloaded
+// certificates take effect without a restart.
+func clientAuthTLSConfig(base *tls.Config, clientCAs *atomic.Value) *tls.Config {
+	tlsConfig := base.Clone()
+	tlsConfig.ClientAuth = httpsClientAuth
+	tlsConfig.ClientCAs = clientCAs.Load().(*x509.CertPool)
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cfg := tlsConfig.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.ClientCAs = clientCAs.Load().(*x509.CertPool)
+		return cfg, nil
 	}
-
-	h.ServeHTTP(rw, r)
+	return tlsConfig
 }
 
-func betaOrRedirectFrontendHandler(rw http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("omnisci-beta")
-	if err != nil || cookie.Value != "true" {
-		http.Redirect(rw, r, "/", http.StatusTemporaryRedirect)
-		return
+// listen opens the main TCP listener, applying --tcp-keepalive and --reuse-port.
+func listen(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: tcpKeepAlive}
+	if reusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
 	}
-
-	thriftOrFrontendHandler(rw, r)
+	return lc.Listen(context.Background(), "tcp", addr)
 }
 
-func httpToHTTPSRedirectHandler(rw http.ResponseWriter, r *http.Request) {
-	// Redirect HTTP request to same URL with only two changes: https scheme,
-	// and the main server port configured in the 'port' param, rather than the
-	// incoming port ('http-to-https-redirect-port')
-	requestHost, _, _ := net.SplitHostPort(r.Host)
-	redirectURL := url.URL{Scheme: "https", Host: requestHost + ":" + strconv.Itoa(port), Path: r.URL.Path, RawQuery: r.URL.RawQuery}
-	http.Redirect(rw, r, redirectURL.String(), http.StatusTemporaryRedirect)
+// builtinPaths are the patterns newMuxes registers for the server's own
+// endpoints.
+var builtinPaths = map[string]bool{
+	"/": true, "/saml-post": true, "/upload": true, "/upload/resumable": true,
+	"/upload/resumable/": true, "/downloads/": true, "/deleteUpload": true,
+	"/servers.json": true, "/beta/": true, "/beta/opt-in": true,
+	"/beta/opt-out": true, "/docs/": true, "/version.txt": true, "/ping": true,
+	"/health": true, "/ready": true, "/readyz": true, "/_internal/": true,
+	"/_internal/clear-servers-json": true, "/_internal/cleanup-uploads": true,
+	"/metrics/": true, "/metrics/reset/": true, "/metrics/requests/": true,
+	"/admin/maintenance": true, "/admin/read-only": true, "/admin/banner": true,
+	"/healthz/backends": true, "/debug/pprof/": true, "/debug/pprof/cmdline": true,
+	"/debug/pprof/profile": true, "/debug/pprof/symbol": true, "/debug/vars": true,
 }
 
-func (rp *reverseProxy) proxyHandler(rw http.ResponseWriter, r *http.Request) {
-	h := http.StripPrefix(rp.Path, httputil.NewSingleHostReverseProxy(rp.Target))
-	h.ServeHTTP(rw, r)
+// checkPaths verifies that the paths of reverse proxies, static mounts and the
+// servers.json set endpoint neither take over built-in endpoints nor each
+// other, which the mux would only refuse with a panic.
+func checkPaths() error {
+	claimed := make(map[string]string)
+	claim := func(path, what string) error {
+		if builtinPaths[path] {
+			return errors.New(what + " path " + path + " is reserved for a built-in endpoint")
+		}
+		if other, ok := claimed[path]; ok {
+			return errors.New(what + " path " + path + " is already used by a " + other)
+		}
+		claimed[path] = what
+		return nil
+	}
+	if !disableServersJSON {
+		if err := claim(serversJSONSetPath, "servers.json set"); err != nil {
+			return err
+		}
+	}
+	for _, rp := range proxies {
+		if err := claim(rp.Path, "reverse proxy"); err != nil {
+			return err
+		}
+	}
+	for _, sm := range staticMounts {
+		if err := claim(sm.Path, "static mount"); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func downloadsHandler(rw http.ResponseWriter, r *http.Request) {
-	if r.RequestURI == "/downloads/" {
-		rw.Write([]byte(""))
-		return
+// newMuxes returns the mux of the public endpoints, and that of the
+// administrative ones, which is the same mux unless an admin listener keeps
+// them away from public traffic.
+func newMuxes() (mux, adminMux *http.ServeMux) {
+	mux = http.NewServeMux()
+	mux.HandleFunc("/saml-post", samlPostHandler)
+	mux.HandleFunc("/upload", uploadHandler)
+	mux.HandleFunc("/upload/resumable", resumableUploadHandler)
+	mux.HandleFunc("/upload/resumable/", resumableUploadHandler)
+	mux.HandleFunc("/downloads/", downloadsHandler)
+	mux.HandleFunc("/deleteUpload", deleteUploadHandler)
+	mux.HandleFunc("/servers.json", serversHandler)
+	mux.HandleFunc("/", thriftOrFrontendHandler)
+	mux.HandleFunc("/beta/", betaOrRedirectFrontendHandler)
+	mux.HandleFunc("/beta/opt-in", betaOptInHandler)
+	mux.HandleFunc("/beta/opt-out", betaOptOutHandler)
+	mux.HandleFunc("/docs/", docsHandler)
+	mux.HandleFunc("/version.txt", versionHandler)
+	mux.HandleFunc("/ping", pingHandler)
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/ready", readyHandler)
+	mux.HandleFunc("/readyz", readyHandler)
+	if !disableServersJSON {
+		mux.HandleFunc(serversJSONSetPath, setServersJSONHandler)
+		mux.HandleFunc("/_internal/clear-servers-json", clearServersJSONHandler)
 	}
-	h := http.StripPrefix("/downloads/", http.FileServer(http.Dir(dataDir+"/mapd_export/")))
-	h.ServeHTTP(rw, r)
-}
+	mux.HandleFunc("/_internal/", internalNotFoundHandler)
 
-func modifyServersJSON(r *http.Request, orig []byte) ([]byte, error) {
-	session, _ := sessionStore.Get(r, "servers-json")
-	j, err := gabs.ParseJSON(orig)
-	if err != nil {
-		return nil, err
+	// Administrative endpoints are served on the main port, unless a separate
+	// debug port keeps them away from public traffic.
+	adminMux = mux
+	if separateAdmin {
+		adminMux = http.NewServeMux()
+	}
+	adminMux.HandleFunc("/metrics/", adminHandler(metricsHandler))
+	adminMux.HandleFunc("/metrics/reset/", adminHandler(metricsResetHandler))
+	adminMux.HandleFunc("/metrics/requests/", adminHandler(requestTimingsHandler))
+	adminMux.HandleFunc("/admin/maintenance", adminHandler(maintenanceModeHandler))
+	// Read-only mode stops uploads for everyone, so only gated admin endpoints
+	// may switch it.
+	if adminGated() {
+		adminMux.HandleFunc("/admin/read-only", adminHandler(readOnlyModeHandler))
+	} else {
+		adminMux.HandleFunc("/admin/read-only", adminHandler(readOnlyStatusHandler))
 	}
+	adminMux.HandleFunc("/admin/banner", adminHandler(bannerHandler))
+	adminMux.HandleFunc("/healthz/backends", adminHandler(healthBackendsHandler))
+	adminMux.HandleFunc("/_internal/cleanup-uploads", adminHandler(cleanupUploadsHandler))
 
-	jj, err := j.Children()
-	if err != nil {
-		return nil, err
+	if profile {
+		adminMux.HandleFunc("/debug/pprof/", adminHandler(pprof.Index))
+		adminMux.HandleFunc("/debug/pprof/cmdline", adminHandler(pprof.Cmdline))
+		adminMux.HandleFunc("/debug/pprof/profile", adminHandler(pprof.Profile))
+		adminMux.HandleFunc("/debug/pprof/symbol", adminHandler(pprof.Symbol))
+		adminMux.HandleFunc("/debug/vars", adminHandler(expvar.Handler().ServeHTTP))
 	}
 
-	for _, key := range serversJSONParams {
-		if session.Values[key] != nil {
-			_, err = jj[0].Set(session.Values[key].(string), key)
-			if err != nil {
-				return nil, err
-			}
-		}
+	for k := range proxies {
+		rp := proxies[k]
+		log.Infoln("Proxy:", rp.Path, "to", rp.Target)
+		mux.HandleFunc(rp.Path, rp.proxyHandler)
 	}
 
-	return j.BytesIndent("", "  "), nil
+	for k := range staticMounts {
+		sm := staticMounts[k]
+		log.Infoln("Static mount:", sm.Path, "from", sm.Dir)
+		mux.HandleFunc(sm.Path, sm.staticHandler)
+	}
+
+	return mux, adminMux
 }
 
-func serversHandler(rw http.ResponseWriter, r *http.Request) {
-	var j []byte
-	servers := ""
-	subDir := filepath.Dir(r.URL.Path)
-	if len(serversJSON) > 0 {
-		servers = serversJSON
-	} else {
-		servers = frontend + subDir + "/servers.json"
-		if _, err := os.Stat(servers); os.IsNotExist(err) {
-			servers = frontend + "/servers.json"
+// checkListeners validates the [[web.listener]] entries. A redirect listener
+// sends clients to --port, which must be served by a public TLS listener, and
+// needs a port of its own, as with --http-to-https-redirect-port.
+func checkListeners(lcs []listenerConfig) error {
+	addrs := make(map[string]bool)
+	ports := make([]int, len(lcs))
+	for i, lc := range lcs {
+		if lc.Handler != "public" && lc.Handler != "admin" && lc.Handler != "redirect" {
+			return errors.New("Invalid listener handler, need public, admin or redirect: " + lc.Handler)
+		}
+		_, p, err := net.SplitHostPort(lc.Address)
+		if err != nil {
+			return errors.New("Invalid listener address: " + lc.Address)
 		}
+		if ports[i], err = net.LookupPort("tcp", p); err != nil {
+			return errors.New("Invalid listener port: " + lc.Address)
+		}
+		if addrs[lc.Address] {
+			return errors.New("Duplicate listener address: " + lc.Address)
+		}
+		addrs[lc.Address] = true
 	}
-	j, err := ioutil.ReadFile(servers)
-	if err != nil {
-		s := server{}
-		s.Master = true
-		s.Username = "admin"
-		s.Password = "HyperInteractive"
-		s.Database = "omnisci"
 
-		h, p, _ := net.SplitHostPort(r.Host)
-		s.Port, _ = net.LookupPort("tcp", p)
-		s.Host = h
-		// handle IPv6 addresses
-		ip := net.ParseIP(h)
-		if ip != nil && ip.To4() == nil {
-			s.Host = "[" + h + "]"
+	for i, lc := range lcs {
+		if lc.Handler != "redirect" {
+			continue
+		}
+		if lc.TLS {
+			return errors.New("HTTP to HTTPS redirect listener must not use TLS: " + lc.Address)
+		}
+		if ports[i] == 0 {
+			return errors.New("Invalid HTTP to HTTPS redirect port: " + lc.Address)
+		}
+		target := false
+		for j, other := range lcs {
+			if j != i && ports[j] == ports[i] {
+				return errors.New("HTTP to HTTPS redirect listener " + lc.Address + " must use a different port than " + other.Address)
+			}
+			target = target || (other.Handler == "public" && other.TLS && ports[j] == port)
+		}
+		if !target {
+			return errors.New("HTTP to HTTPS redirect listener " + lc.Address + " redirects to port " + strconv.Itoa(port) + ", which no public TLS listener serves")
 		}
-
-		ss := []server{s}
-		j, _ = json.Marshal(ss)
 	}
+	return nil
+}
 
-	jj, err := modifyServersJSON(r, j)
-	if err != nil {
-		msg := "Error processing servers.json: " + err.Error()
-		http.Error(rw, msg, http.StatusInternalServerError)
-		log.Println(msg)
-		return
+// newDrain returns the function run before each listener is closed, which
+// keeps accepting requests for --pre-shutdown-delay while load balancers
+// notice /ready failing and drain the server. The delay is waited once, by
+// all listeners together.
+func newDrain() func() {
+	var drainOnce sync.Once
+	return func() {
+		drainOnce.Do(func() {
+			log.Infoln("Shutdown initiated, marking server as not ready")
+			atomic.StoreInt32(&draining, 1)
+			if preShutdownDelay > 0 {
+				log.Infoln("Waiting", preShutdownDelay, "for load balancers to drain connections")
+				time.Sleep(preShutdownDelay)
+			}
+		})
+		log.Infoln("Closing listener and waiting for open requests to finish")
 	}
-
-	rw.Header().Del("Cache-Control")
-	rw.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate")
-	rw.Write(jj)
 }
 
-func versionHandler(rw http.ResponseWriter, r *http.Request) {
-	outVers := "OmniSciDB:\n" + version
-	versTxt := frontend + "/version.txt"
-	feVers, err := ioutil.ReadFile(versTxt)
-	if err == nil {
-		outVers += "\n\n"
-		outVers += "Immerse:\n"
-		outVers += string(feVers)
+// newServers returns a server for each of the listeners, serving the public or
+// admin handler, or redirecting to HTTPS. They all shut down together.
+func newServers(public, admin http.Handler, tlsConfig *tls.Config) []*graceful.Server {
+	beforeShutdown := newDrain()
+	servers := make([]*graceful.Server, len(listeners))
+	for i, lc := range listeners {
+		srv := &graceful.Server{
+			Timeout:        5 * time.Second,
+			BeforeShutdown: beforeShutdown,
+			Server: &http.Server{
+				Addr:         lc.Address,
+				ReadTimeout:  connTimeout,
+				WriteTimeout: connTimeout,
+				ErrorLog:     stdlog.New(serverErrorLog{}, "", 0),
+				ConnContext:  saveConnContext,
+			},
+		}
+		switch lc.Handler {
+		case "public":
+			srv.Handler = public
+		case "admin":
+			srv.Handler = admin
+		case "redirect":
+			srv.Handler = allowedHostHandler(http.HandlerFunc(httpToHTTPSRedirectHandler))
+		}
+		if lc.TLS {
+			srv.TLSConfig = tlsConfig
+		}
+		servers[i] = srv
 	}
-	rw.Write([]byte(outVers))
+	return servers
 }
 
 func main() {
@@ -813,95 +5483,147 @@ func main() {
 		alog = io.MultiWriter(os.Stdout, alf)
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/saml-post", samlPostHandler)
-	mux.HandleFunc("/upload", uploadHandler)
-	mux.HandleFunc("/downloads/", downloadsHandler)
-	mux.HandleFunc("/deleteUpload", deleteUploadHandler)
-	mux.HandleFunc("/servers.json", serversHandler)
-	mux.HandleFunc("/", thriftOrFrontendHandler)
-	mux.HandleFunc("/beta/", betaOrRedirectFrontendHandler)
-	mux.HandleFunc("/docs/", docsHandler)
-	mux.HandleFunc("/metrics/", metricsHandler)
-	mux.HandleFunc("/metrics/reset/", metricsResetHandler)
-	mux.HandleFunc("/version.txt", versionHandler)
-	mux.HandleFunc("/_internal/set-servers-json", setServersJSONHandler)
-	mux.HandleFunc("/_internal/clear-servers-json", clearServersJSONHandler)
-
-	if profile {
-		mux.HandleFunc("/debug/pprof/", pprof.Index)
-		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	if !proxyAll {
+		checkFrontendIndex()
 	}
 
-	for k := range proxies {
-		rp := proxies[k]
-		log.Infoln("Proxy:", rp.Path, "to", rp.Target)
-		mux.HandleFunc(rp.Path, rp.proxyHandler)
+	healthTargets = append(healthTargets, &healthTarget{name: "backend", probe: probeBackend})
+	if fallbackBackendURL != nil {
+		healthTargets = append(healthTargets, &healthTarget{
+			name:  "fallback",
+			probe: func() error { return dialURL(fallbackBackendURL) },
+		})
+	}
+	if checkDiskWritable {
+		for _, dir := range []string{dataDir, os.TempDir()} {
+			dir := dir
+			healthTargets = append(healthTargets, &healthTarget{
+				name:  "disk:" + dir,
+				probe: func() error { return probeWritable(dir) },
+			})
+		}
+	}
+	for _, rp := range proxies {
+		target := rp.Target
+		healthTargets = append(healthTargets, &healthTarget{
+			name:  "proxy:" + rp.Path,
+			probe: func() error { return dialURL(target) },
+		})
+	}
+	go watchHealth()
+	if warmupConnections > 0 {
+		atomic.StoreInt32(&warmingUp, 1)
+		go warmBackend()
+	}
+	if uploadTTL > 0 {
+		go watchUploads()
+	}
+	if metricsDumpInterval > 0 {
+		if metricsDumpFile == "" {
+			metricsDumpFile = dataDir + "/mapd_log/omnisci_web_server.metrics.json"
+		}
+		go dumpMetrics()
 	}
 
+	mux, adminMux := newMuxes()
+
 	c := cors.New(cors.Options{
-		AllowedHeaders: []string{"Accept", "Cache-Control", "Content-Type", "sessionid", "X-Requested-With"},
+		AllowedHeaders: corsAllowedHeaders,
+		AllowedMethods: corsAllowedMethods,
+		MaxAge:         corsMaxAge,
 	})
-	cmux := c.Handler(mux)
-	cmux = handlers.LoggingHandler(alog, cmux)
+	cmux := corsHandler(c, mux)
+	cmux = maintenanceHandler(cmux)
+	cmux = allowedHostHandler(cmux)
+	if len(blockedUserAgents) > 0 {
+		cmux = blockedUserAgentHandler(cmux)
+	}
+	cmux = endpointPolicyHandler(cmux)
+	cmux = accessLogHandler(alog, cmux)
 	cmux = thriftTimingHandler(cmux)
 	if compress {
-		cmux = handlers.CompressHandler(cmux)
+		cmux = compressHandler(cmux)
+	}
+	cmux = serverHeaderHandler(cmux)
+	if otelEndpoint != "" {
+		cmux = tracingHandler(cmux)
+		go exportSpans()
 	}
+	cmux = requestIDHandler(cmux)
 
 	tlsConfig := &tls.Config{}
+	var clientCAs atomic.Value
 	if enableHTTPSAuth {
-		caCert, err := ioutil.ReadFile(peerCertFile)
+		caCertPool, n, err := loadCACertPool(peerCertFile)
 		if err != nil {
 			log.Fatalln("Errors opening peer file:", err, peerCertFile)
 		}
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caCert)
-		tlsConfig = &tls.Config{
-			ClientCAs:  caCertPool,
-			ClientAuth: tls.RequireAndVerifyClientCert,
-		}
-		tlsConfig.BuildNameToCertificate()
+		log.Infoln("Loaded", n, "peer CA certificates from", peerCertFile)
+		clientCAs.Store(caCertPool)
 
+		if peerCertReload > 0 {
+			go watchPeerCerts(&clientCAs)
+		}
 	}
 
-	srv := &graceful.Server{
-		Timeout: 5 * time.Second,
-		Server: &http.Server{
-			Addr:         ":" + strconv.Itoa(port),
-			Handler:      cmux,
-			ReadTimeout:  connTimeout,
-			WriteTimeout: connTimeout,
-			TLSConfig:    tlsConfig,
-		},
+	useTLS := false
+	for _, lc := range listeners {
+		useTLS = useTLS || lc.TLS
 	}
-
-	if enableHTTPS {
+	if useTLS {
 		if _, err := os.Stat(certFile); err != nil {
 			log.Fatalln("Error opening certificate:", err)
 		}
 		if _, err := os.Stat(keyFile); err != nil {
 			log.Fatalln("Error opening keyfile:", err)
 		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Fatalln("Error loading certificate:", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
 
-		if enableHTTPSRedirect {
-			go func() {
-				err := http.ListenAndServe(":"+strconv.Itoa(httpsRedirectPort), http.HandlerFunc(httpToHTTPSRedirectHandler))
+	if enableHTTPSAuth {
+		tlsConfig = clientAuthTLSConfig(tlsConfig, &clientCAs)
+	}
 
-				if err != nil {
-					log.Fatalln("Error starting http redirect listener:", err)
-				}
-			}()
-		}
+	servers := newServers(cmux, requestIDHandler(accessLogHandler(alog, endpointPolicyHandler(adminMux))), tlsConfig)
 
-		err = srv.ListenAndServeTLS(certFile, keyFile)
-	} else {
-		err = srv.ListenAndServe()
+	// Load balancers and clients only see the server once the backend is up
+	if waitForBackend > 0 {
+		awaitBackend()
 	}
 
-	if err != nil {
-		log.Fatal("Error starting http server: ", err)
+	// Bind everything before serving anything, so that a bad address stops
+	// the server before it takes any requests.
+	ls := make([]net.Listener, len(listeners))
+	for i, lc := range listeners {
+		l, err := listen(lc.Address)
+		if err != nil {
+			log.Fatalln("Error starting "+lc.Handler+" listener:", err)
+		}
+		if lc.TLS {
+			l = tls.NewListener(l, tlsConfig)
+		}
+		ls[i] = l
+	}
+
+	// Every server shuts down on the same signal
+	var wg sync.WaitGroup
+	for i, lc := range listeners {
+		wg.Add(1)
+		go func(srv *graceful.Server, l net.Listener, lc listenerConfig) {
+			defer wg.Done()
+			log.Infoln("Serving", lc.Handler, "endpoints on", lc.Address)
+			if err := srv.Serve(l); err != nil {
+				log.Fatalln("Error starting "+lc.Handler+" server:", err)
+			}
+		}(servers[i], ls[i], lc)
+	}
+	wg.Wait()
+	if otelEndpoint != "" {
+		stopSpans(5 * time.Second)
 	}
+	log.Infoln("Shutdown complete")
 }
@@ -0,0 +1,2400 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andrewseidl/viper"
+	"github.com/google/uuid"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/rs/cors"
+	log "github.com/sirupsen/logrus"
+)
+
+// The server's init parses the command line, which under go test holds the
+// test flags. It gets a command line of its own instead, and TestMain hands
+// the test flags back to the testing package.
+var testArgs = func() []string {
+	args := os.Args
+	os.Args = []string{args[0], "--data", os.TempDir()}
+	return args
+}()
+
+func TestMain(m *testing.M) {
+	os.Args = testArgs
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func TestThriftSessionPlaceholderReplaced(t *testing.T) {
+	mb := newMockBackend(t)
+	newFrontendFixture(t)
+
+	r := newThriftRequest(thriftCall("sql_execute", samlPlaceholderSessionID))
+	for _, c := range samlCookies(mockSessionID) {
+		r.AddCookie(c)
+	}
+	rw := httptest.NewRecorder()
+	thriftOrFrontendHandler(rw, r)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rw.Code)
+	}
+	if rw.Body.String() != sqlExecuteResponse(12, 34) {
+		t.Errorf("response %q is not the backend's", rw.Body.String())
+	}
+	calls := mb.callsOf("sql_execute")
+	if len(calls) != 1 {
+		t.Fatalf("backend got %d sql_execute calls, want 1", len(calls))
+	}
+	if want := thriftCall("sql_execute", mockSessionID); calls[0].Body != want {
+		t.Errorf("backend got %s, want %s", calls[0].Body, want)
+	}
+}
+
+func TestThriftSessionPlaceholderKeptWithoutSAML(t *testing.T) {
+	mb := newMockBackend(t)
+	newFrontendFixture(t)
+
+	r := newThriftRequest(thriftCall("sql_execute", samlPlaceholderSessionID))
+	r.AddCookie(&http.Cookie{Name: thriftSessionCookieName, Value: mockSessionID})
+	thriftOrFrontendHandler(httptest.NewRecorder(), r)
+
+	calls := mb.callsOf("sql_execute")
+	if len(calls) != 1 || calls[0].Body != thriftCall("sql_execute", samlPlaceholderSessionID) {
+		t.Errorf("backend got %v, want the call unchanged", calls)
+	}
+}
+
+func TestSAMLPostConnect(t *testing.T) {
+	mb := newMockBackend(t)
+
+	form := url.Values{"SAMLResponse": {"PHNhbWxwOlJlc3BvbnNlPg=="}, "RelayState": {"/dashboard/1"}}
+	r := httptest.NewRequest("POST", "/saml-post", bytes.NewBufferString(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := httptest.NewRecorder()
+	samlPostHandler(rw, r)
+
+	if rw.Code != http.StatusMovedPermanently || rw.Header().Get("Location") != "/dashboard/1" {
+		t.Fatalf("got %d to %q, want 301 to /dashboard/1", rw.Code, rw.Header().Get("Location"))
+	}
+	calls := mb.callsOf("connect")
+	if len(calls) != 1 || !strings.Contains(calls[0].Body, `"2":{"str":"PHNhbWxwOlJlc3BvbnNlPg=="}`) {
+		t.Fatalf("backend got %v, want a connect with the SAML response", calls)
+	}
+
+	cookies := make(map[string]string)
+	for _, c := range rw.Result().Cookies() {
+		cookies[c.Name] = c.Value
+	}
+	if cookies[thriftSessionCookieName] != mockSessionID || cookies[samlAuthCookieName] != "true" ||
+		cookies[samlSignatureCookieName] != samlSignature(mockSessionID) {
+		t.Errorf("got cookies %v, want the session, flag and signature", cookies)
+	}
+}
+
+func TestSAMLPostConnectRejected(t *testing.T) {
+	mb := newMockBackend(t)
+	mb.respond("connect", `[1,"connect",2,0,{"1":{"rec":{"1":{"str":"Invalid credentials."}}}}]`)
+
+	form := url.Values{"SAMLResponse": {"PHNhbWxwOlJlc3BvbnNlPg=="}}
+	r := httptest.NewRequest("POST", "/saml-post", bytes.NewBufferString(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := httptest.NewRecorder()
+	samlPostHandler(rw, r)
+
+	if rw.Code != http.StatusSeeOther || rw.Header().Get("Location") != samlErrorPage+"?reason=rejected" {
+		t.Errorf("got %d to %q, want 303 to the error page", rw.Code, rw.Header().Get("Location"))
+	}
+	if len(rw.Result().Cookies()) != 0 {
+		t.Errorf("rejected login set cookies %v", rw.Result().Cookies())
+	}
+}
+
+func TestThriftTimingMetrics(t *testing.T) {
+	newMockBackend(t)
+	newFrontendFixture(t)
+	useMetrics(t)
+	h := thriftTimingHandler(http.HandlerFunc(thriftOrFrontendHandler))
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, newThriftRequest(thriftCall("sql_execute", mockSessionID)))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rw.Code)
+	}
+
+	want := map[string]time.Duration{
+		"sql_execute.execution_time_ms": 12 * time.Millisecond,
+		"sql_execute.total_time_ms":     34 * time.Millisecond,
+	}
+	for name, d := range want {
+		if got := time.Duration(waitForTimer(t, name).Max()); got != d {
+			t.Errorf("%s is %v, want %v", name, got, d)
+		}
+	}
+	for _, name := range []string{"all", "sql_execute"} {
+		if m, ok := registry.Get(name).(metrics.Timer); !ok || m.Count() != 1 {
+			t.Errorf("timer %s not recorded once", name)
+		}
+	}
+}
+
+func TestUploadExpectContinue(t *testing.T) {
+	dir := newUploadFixture(t, "upload-session")
+	srv := httptest.NewServer(http.HandlerFunc(uploadHandler))
+	defer srv.Close()
+
+	// The client holds the body back until the server asks for it, or for
+	// far longer than the test is willing to wait.
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: time.Minute}}
+	body, ct := multipartBody(t, map[string]string{"data.csv": "a,b\n1,2\n"}, nil)
+	req, _ := http.NewRequest("POST", srv.URL, body)
+	req.Header.Set("Content-Type", ct)
+	req.Header.Set("Expect", "100-continue")
+	req.Header.Set("sessionid", "upload-session")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("upload took %v, the interim response was not sent", d)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "data.csv")); err != nil || string(b) != "a,b\n1,2\n" {
+		t.Errorf("stored %q, %v", b, err)
+	}
+}
+
+func TestUploadExpectContinueRefused(t *testing.T) {
+	dir := newUploadFixture(t, "upload-session")
+	setGlobal(t, &uploadContinue, false)
+	srv := httptest.NewServer(http.HandlerFunc(uploadHandler))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: time.Minute}}
+	body, ct := multipartBody(t, map[string]string{"data.csv": "a,b\n1,2\n"}, nil)
+	req, _ := http.NewRequest("POST", srv.URL, body)
+	req.Header.Set("Content-Type", ct)
+	req.Header.Set("Expect", "100-continue")
+	req.Header.Set("sessionid", "upload-session")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusExpectationFailed {
+		t.Errorf("status %d, want 417", resp.StatusCode)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("refused upload created %s", dir)
+	}
+}
+
+func TestUploadTimeoutStalledClient(t *testing.T) {
+	newUploadFixture(t, "upload-session")
+	setGlobal(t, &uploadTimeout, 200*time.Millisecond)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(uploadHandler))
+	srv.Config.ConnContext = saveConnContext
+	srv.Start()
+	defer srv.Close()
+
+	// Send part of the body and then nothing, leaving the handler blocked in a
+	// read.
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "POST /upload HTTP/1.1\r\nHost: localhost\r\nsessionid: upload-session\r\n"+
+		"Content-Type: multipart/form-data; boundary=X\r\nContent-Length: 100000\r\n\r\n"+
+		"--X\r\nContent-Disposition: form-data; name=\"file\"; filename=\"data.csv\"\r\n\r\na,b\n")
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("no response to the stalled upload: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("status %d, want 408", resp.StatusCode)
+	}
+}
+
+func TestDocsCacheTTL(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "guide.pdf"), "%PDF-1.4")
+	setGlobal(t, &docsDir, dir)
+
+	for ttl, want := range map[time.Duration]string{0: "", time.Hour: "public, max-age=3600"} {
+		setGlobal(t, &docsCacheTTL, ttl)
+		rw := httptest.NewRecorder()
+		docsHandler(rw, httptest.NewRequest("GET", "/docs/guide.pdf", nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("status %d, want 200", rw.Code)
+		}
+		if got := rw.Header().Get("Cache-Control"); got != want {
+			t.Errorf("with a TTL of %v, Cache-Control is %q, want %q", ttl, got, want)
+		}
+	}
+}
+
+func TestAccessLogRedactsParams(t *testing.T) {
+	setGlobal(t, &logStripParams, map[string]bool{"password": true})
+	var out bytes.Buffer
+	h := accessLogHandler(&out, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("Password") != "hunter2" {
+			t.Errorf("handler got %q, want the original query", r.URL.RawQuery)
+		}
+	}))
+
+	r := httptest.NewRequest("GET", "/_internal/set-servers-json?username=bob&Password=hunter2", nil)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	line := out.String()
+	if !strings.Contains(line, "/_internal/set-servers-json?username=bob&Password=REDACTED ") {
+		t.Errorf("log line %q does not have the password redacted", line)
+	}
+	if strings.Contains(line, "hunter2") {
+		t.Errorf("log line %q leaks the password", line)
+	}
+}
+
+func TestUploadSessionTrustedHeader(t *testing.T) {
+	setGlobal(t, &uploadSessionHeader, "X-Verified-Session")
+	trusted, _ := parseCIDRs([]string{"10.0.0.0/8"})
+	setGlobal(t, &trustedProxies, trusted)
+	hashed := func(sid string) string {
+		sum := sha256.Sum256([]byte(sid))
+		return hex.EncodeToString(sum[:])
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		saml   bool
+		want   string
+	}{
+		{"trusted peer", "10.1.2.3:4000", false, hashed("proxy-session")},
+		{"trusted peer over SAML", "10.1.2.3:4000", true, hashed("proxy-session")},
+		{"untrusted peer", "192.0.2.1:4000", false, ""},
+		{"untrusted peer with SAML", "192.0.2.1:4000", true, hashed("saml-session")},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/upload", nil)
+		r.RemoteAddr = tt.remote
+		r.Header.Set("X-Verified-Session", "proxy-session")
+		r.Header.Set("sessionid", "spoofed-session")
+		if tt.saml {
+			for _, c := range samlCookies("saml-session") {
+				r.AddCookie(c)
+			}
+		}
+		if got := uploadSessionID(r); got != tt.want {
+			t.Errorf("%s: session %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProxyAllGET(t *testing.T) {
+	mb := newMockBackend(t)
+	newFrontendFixture(t)
+	setGlobal(t, &proxyAll, true)
+
+	rw := httptest.NewRecorder()
+	thriftOrFrontendHandler(rw, httptest.NewRequest("GET", "/app.js?v=2", nil))
+
+	if strings.Contains(rw.Body.String(), "immerse") {
+		t.Errorf("served the local frontend file in proxy-all mode")
+	}
+	calls := mb.callsOf("")
+	if len(calls) != 1 || calls[0].Path != "/app.js?v=2" {
+		t.Errorf("backend got %v, want the GET of /app.js?v=2", calls)
+	}
+}
+
+func TestSAMLPostConnectRetried(t *testing.T) {
+	mb := newMockBackend(t)
+	mb.fail("connect", http.StatusServiceUnavailable)
+	setGlobal(t, &samlConnectRetries, 2)
+
+	form := url.Values{"SAMLResponse": {"PHNhbWxwOlJlc3BvbnNlPg=="}}
+	r := httptest.NewRequest("POST", "/saml-post", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := httptest.NewRecorder()
+	samlPostHandler(rw, r)
+
+	if rw.Code != http.StatusMovedPermanently {
+		t.Errorf("status %d to %q, want the login to complete", rw.Code, rw.Header().Get("Location"))
+	}
+	if n := len(mb.callsOf("connect")); n != 2 {
+		t.Errorf("backend got %d connect calls, want 2", n)
+	}
+}
+
+func TestSAMLPostConnectRejectionNotRetried(t *testing.T) {
+	mb := newMockBackend(t)
+	mb.respond("connect", `[1,"connect",2,0,{"1":{"rec":{"1":{"str":"Invalid credentials."}}}}]`)
+	setGlobal(t, &samlConnectRetries, 2)
+
+	form := url.Values{"SAMLResponse": {"PHNhbWxwOlJlc3BvbnNlPg=="}}
+	r := httptest.NewRequest("POST", "/saml-post", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	samlPostHandler(httptest.NewRecorder(), r)
+
+	if n := len(mb.callsOf("connect")); n != 1 {
+		t.Errorf("backend got %d connect calls, want 1", n)
+	}
+}
+
+func TestCORSPreflightDefaultMethods(t *testing.T) {
+	c := cors.New(cors.Options{
+		AllowedHeaders: corsAllowedHeaders,
+		AllowedMethods: corsAllowedMethods,
+		MaxAge:         corsMaxAge,
+	})
+	h := c.Handler(http.NotFoundHandler())
+
+	for _, method := range []string{"GET", "HEAD", "POST", "DELETE"} {
+		r := httptest.NewRequest("OPTIONS", "/upload", nil)
+		r.Header.Set("Origin", "https://embedding.example.com")
+		r.Header.Set("Access-Control-Request-Method", method)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, r)
+		if got := rw.Header().Get("Access-Control-Allow-Methods"); got != method {
+			t.Errorf("preflight for %s allows %q", method, got)
+		}
+	}
+}
+
+func TestHTTPSClientAuthModes(t *testing.T) {
+	ca := newTestCA(t, "peer CA")
+	var clientCAs atomic.Value
+	clientCAs.Store(ca.pool())
+	base := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "localhost")}}
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		mode       tls.ClientAuthType
+		clientCert bool
+		wantErr    bool
+	}{
+		{tls.VerifyClientCertIfGiven, false, false},
+		{tls.VerifyClientCertIfGiven, true, false},
+		{tls.RequireAndVerifyClientCert, false, true},
+		{tls.RequireAndVerifyClientCert, true, false},
+	}
+	for _, tt := range tests {
+		setGlobal(t, &httpsClientAuth, tt.mode)
+		srv := newTLSServer(t, ok, clientAuthTLSConfig(base, &clientCAs))
+		client := tlsClient(ca)
+		if tt.clientCert {
+			client = tlsClient(ca, ca.issue(t, "client"))
+		}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("mode %v, client cert %v: got error %v", tt.mode, tt.clientCert, err)
+		}
+	}
+}
+
+// largeSQLExecuteResponse is a sql_execute response of about size bytes, with
+// the backend timings at its end.
+func largeSQLExecuteResponse(size int) []byte {
+	row := []byte(`{"1":{"rec":{"1":{"i64":42},"2":{"str":"row"}}}},`)
+	var b bytes.Buffer
+	b.WriteString(`[1,"sql_execute",2,0,{"0":{"rec":{"1":{"rec":{"1":{"lst":["rec",0,`)
+	for b.Len() < size {
+		b.Write(row)
+	}
+	b.WriteString(`]}}},"2":{"i64":12},"3":{"i64":34},"4":{"str":""}}}}]`)
+	return b.Bytes()
+}
+
+func TestTailBufferTimings(t *testing.T) {
+	resp := largeSQLExecuteResponse(1 << 20)
+	buf := newTailBuffer(64 << 10)
+	mw := &ResponseMultiWriter{Writer: buf, ResponseWriter: &discardResponseWriter{}}
+	for b := resp; len(b) > 0; {
+		n := 1000
+		if n > len(b) {
+			n = len(b)
+		}
+		mw.Write(b[:n])
+		b = b[n:]
+	}
+	mw.Close()
+
+	if got, want := buf.String(), string(resp[len(resp)-64<<10:]); got != want {
+		t.Fatalf("tail buffer kept %d bytes that are not the end of the response", len(got))
+	}
+	timings := backendTimings(thriftMethodMap["sql_execute"], buf.String())
+	if timings["execution_time_ms"] != 12*time.Millisecond || timings["total_time_ms"] != 34*time.Millisecond {
+		t.Errorf("timings %v, want 12ms execution and 34ms total", timings)
+	}
+}
+
+// BenchmarkResponseTee compares the memory used to tee a large response for
+// its timings into the whole-response buffer used before, and into the tail
+// buffer.
+func BenchmarkResponseTee(b *testing.B) {
+	resp := largeSQLExecuteResponse(64 << 20)
+	tee := func(w io.Writer) {
+		mw := &ResponseMultiWriter{Writer: w, ResponseWriter: &discardResponseWriter{}}
+		for off := 0; off < len(resp); off += 32 << 10 {
+			end := off + 32<<10
+			if end > len(resp) {
+				end = len(resp)
+			}
+			mw.Write(resp[off:end])
+		}
+		mw.Close()
+	}
+
+	b.Run("buffer", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(resp)))
+		for i := 0; i < b.N; i++ {
+			tee(new(bytes.Buffer))
+		}
+	})
+	b.Run("tail", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(resp)))
+		for i := 0; i < b.N; i++ {
+			tee(newTailBuffer(metricsTailBytes))
+		}
+	})
+}
+
+func TestDebugEndpointsOnAdminListener(t *testing.T) {
+	setGlobal(t, &profile, true)
+	for _, separate := range []bool{false, true} {
+		setGlobal(t, &separateAdmin, separate)
+		mux, adminMux := newMuxes()
+		for _, path := range []string{"/debug/pprof/", "/debug/vars", "/metrics/"} {
+			r := httptest.NewRequest("GET", path, nil)
+			_, public := mux.Handler(r)
+			_, admin := adminMux.Handler(r)
+			if admin != path {
+				t.Errorf("admin listener serves %s by %q", path, admin)
+			}
+			if separate && public != "/" {
+				t.Errorf("with an admin listener, the public one serves %s by %q", path, public)
+			}
+		}
+	}
+}
+
+func TestAdminListenerDrains(t *testing.T) {
+	setGlobal(t, &listeners, []listenerConfig{{Handler: "public"}, {Handler: "admin"}})
+	setGlobal(t, &preShutdownDelay, 500*time.Millisecond)
+	setGlobal(t, &draining, 0)
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+	servers := newServers(ok, ok, nil)
+
+	urls := make([]string, len(servers))
+	for i, srv := range servers {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls[i] = "http://" + l.Addr().String()
+		go srv.Serve(l)
+	}
+	for _, srv := range servers {
+		srv.Stop(time.Second)
+	}
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	time.Sleep(100 * time.Millisecond)
+	for i, u := range urls {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Errorf("%s listener closed before the drain delay: %v", listeners[i].Handler, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+	for i, srv := range servers {
+		select {
+		case <-srv.StopChan():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s listener did not shut down", listeners[i].Handler)
+		}
+	}
+	if atomic.LoadInt32(&draining) != 1 {
+		t.Errorf("server not marked as draining")
+	}
+}
+
+func TestThriftSizeMetrics(t *testing.T) {
+	newMockBackend(t)
+	newFrontendFixture(t)
+	useMetrics(t)
+	h := thriftTimingHandler(http.HandlerFunc(thriftOrFrontendHandler))
+
+	call := thriftCall("sql_execute", mockSessionID)
+	h.ServeHTTP(httptest.NewRecorder(), newThriftRequest(call))
+
+	sizes := map[string]int64{
+		"sql_execute.request_bytes":  int64(len(call)),
+		"sql_execute.response_bytes": int64(len(sqlExecuteResponse(12, 34))),
+	}
+	for name, size := range sizes {
+		m, ok := registry.Get(name).(metrics.Histogram)
+		if !ok || m.Count() != 1 || m.Max() != size {
+			t.Errorf("histogram %s = %v, want a single %d", name, m, size)
+		}
+	}
+}
+
+func TestMaintenancePage(t *testing.T) {
+	page := filepath.Join(t.TempDir(), "maintenance.html")
+	writeTestFile(t, page, "<h1>Back soon</h1>")
+	setGlobal(t, &maintenanceFile, page)
+	setGlobal(t, &maintenanceMode, 1)
+	h := maintenanceHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("frontend"))
+	}))
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusServiceUnavailable || rw.Body.String() != "<h1>Back soon</h1>" {
+		t.Errorf("got %d %q, want 503 with the maintenance page", rw.Code, rw.Body.String())
+	}
+	if rw.Header().Get("Retry-After") == "" {
+		t.Errorf("maintenance response lacks Retry-After")
+	}
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("POST", "/admin/maintenance", nil))
+	if rw.Body.String() != "frontend" {
+		t.Errorf("admin endpoints are unreachable in maintenance mode")
+	}
+}
+
+func TestReadOnlySwitchNeedsGating(t *testing.T) {
+	setGlobal(t, &readOnly, 0)
+	setGlobal(t, &enableHTTPSAuth, false)
+	nets, _ := parseCIDRs([]string{"192.0.2.0/24"})
+	send := func(adminMux *http.ServeMux, method string) int {
+		rw := httptest.NewRecorder()
+		adminMux.ServeHTTP(rw, httptest.NewRequest(method, "/admin/read-only?enable=1", nil))
+		return rw.Code
+	}
+
+	for _, tc := range []struct {
+		name     string
+		separate bool
+		cidrs    []*net.IPNet
+		gated    bool
+	}{
+		{"no gating", false, nil, false},
+		{"admin listener", true, nil, true},
+		{"admin CIDRs", false, nets, true},
+	} {
+		setGlobal(t, &separateAdmin, tc.separate)
+		setGlobal(t, &adminAllowedCIDRs, tc.cidrs)
+		atomic.StoreInt32(&readOnly, 0)
+		_, adminMux := newMuxes()
+
+		if code := send(adminMux, "GET"); code != http.StatusOK || isReadOnly() {
+			t.Errorf("%s: GET got %d, read-only %v, want a report without a change", tc.name, code, isReadOnly())
+		}
+		code := send(adminMux, "POST")
+		if isReadOnly() != tc.gated {
+			t.Errorf("%s: POST switched read-only mode %v, want %v", tc.name, isReadOnly(), tc.gated)
+		}
+		if !tc.gated && code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: POST got %d, want 405", tc.name, code)
+		}
+	}
+}
+
+func TestMaintenanceModeToggle(t *testing.T) {
+	logs := captureLog(t)
+	setGlobal(t, &maintenanceMode, 0)
+	toggle := func(method, query string) int {
+		rw := httptest.NewRecorder()
+		maintenanceModeHandler(rw, httptest.NewRequest(method, "/admin/maintenance?"+query, nil))
+		return rw.Code
+	}
+
+	if toggle("GET", "enable=1"); atomic.LoadInt32(&maintenanceMode) != 0 {
+		t.Fatal("GET turned on maintenance mode")
+	}
+	if code := toggle("PUT", "enable=1"); code != http.StatusMethodNotAllowed || atomic.LoadInt32(&maintenanceMode) != 0 {
+		t.Fatalf("PUT got %d, want 405 and no change", code)
+	}
+	if toggle("POST", "enable=1"); atomic.LoadInt32(&maintenanceMode) != 1 {
+		t.Fatal("POST didn't turn on maintenance mode")
+	}
+	if !strings.Contains(logs.String(), "audit=true") || !strings.Contains(logs.String(), "client=192.0.2.1") {
+		t.Errorf("change not audited: %q", logs.String())
+	}
+	if toggle("POST", "disable=1"); atomic.LoadInt32(&maintenanceMode) != 0 {
+		t.Error("POST didn't turn off maintenance mode")
+	}
+}
+
+func TestUploadOutlastsServerTimeout(t *testing.T) {
+	newUploadFixture(t, "upload-session")
+	setGlobal(t, &uploadTimeout, 10*time.Second)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload", uploadHandler)
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+		}
+	})
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Config.ConnContext = saveConnContext
+	srv.Config.ReadTimeout = 300 * time.Millisecond
+	srv.Config.WriteTimeout = 300 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	// post sends the request with its body delayed past the server's
+	// timeouts, and returns the status, or 0 if there was no response.
+	post := func(path string) int {
+		body, ct := multipartBody(t, map[string]string{"data.csv": "a,b\n1,2\n"}, nil)
+		c, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "POST %s HTTP/1.1\r\nHost: localhost\r\nsessionid: upload-session\r\n"+
+			"Content-Type: %s\r\nContent-Length: %d\r\n\r\n", path, ct, body.Len())
+		time.Sleep(600 * time.Millisecond)
+		c.Write(body.Bytes())
+
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := post("/upload"); status != http.StatusOK {
+		t.Errorf("slow upload got status %d, want 200", status)
+	}
+	if status := post("/query"); status == http.StatusOK {
+		t.Errorf("slow query POST outlasted the server timeout")
+	}
+}
+
+func TestPeerCertsFromSeveralCAs(t *testing.T) {
+	server, partnerA, partnerB, other := newTestCA(t, "server CA"), newTestCA(t, "partner A"), newTestCA(t, "partner B"), newTestCA(t, "other")
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "a.pem"), string(partnerA.PEM))
+	writeTestFile(t, filepath.Join(dir, "more", "b.pem"), string(partnerB.PEM))
+
+	pool, n, err := loadCACertPool(filepath.Join(dir, "a.pem") + ", " + filepath.Join(dir, "more"))
+	if err != nil || n != 2 {
+		t.Fatalf("loaded %d CAs, %v; want 2", n, err)
+	}
+	var clientCAs atomic.Value
+	clientCAs.Store(pool)
+	setGlobal(t, &httpsClientAuth, tls.RequireAndVerifyClientCert)
+	base := &tls.Config{Certificates: []tls.Certificate{server.issue(t, "localhost")}}
+	srv := newTLSServer(t, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}), clientAuthTLSConfig(base, &clientCAs))
+
+	for _, ca := range []*testCA{partnerA, partnerB, other} {
+		resp, err := tlsClient(server, ca.issue(t, "client")).Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if wantErr := ca == other; (err != nil) != wantErr {
+			t.Errorf("client of %s: got error %v", ca.cert.Subject.CommonName, err)
+		}
+	}
+
+	if _, _, err := loadCACertPool(filepath.Join(dir, "a.pem") + "," + filepath.Join(dir, "missing.pem")); err == nil {
+		t.Errorf("a missing CA file was accepted")
+	}
+}
+
+func TestBackendHeader(t *testing.T) {
+	fallback := newMockBackend(t)
+	fallbackURL := backendURL
+	primary := newMockBackend(t)
+	newFrontendFixture(t)
+	setGlobal(t, &fallbackBackendURL, fallbackURL)
+	setGlobal(t, &emitBackendHeader, true)
+
+	for _, tt := range []struct {
+		primaryHealthy bool
+		want           *mockBackend
+	}{{true, primary}, {false, fallback}} {
+		setGlobal(t, &healthResults, map[string]*backendHealth{
+			"backend":  {Healthy: tt.primaryHealthy},
+			"fallback": {Healthy: true},
+		})
+		rw := httptest.NewRecorder()
+		thriftOrFrontendHandler(rw, newThriftRequest(thriftCall("sql_execute", mockSessionID)))
+		if got, want := rw.Header().Get("X-OmniSci-Backend"), tt.want.Listener.Addr().String(); got != want {
+			t.Errorf("primary healthy %v: X-OmniSci-Backend %q, want %q", tt.primaryHealthy, got, want)
+		}
+	}
+
+	setGlobal(t, &emitBackendHeader, false)
+	rw := httptest.NewRecorder()
+	thriftOrFrontendHandler(rw, newThriftRequest(thriftCall("sql_execute", mockSessionID)))
+	if got := rw.Header().Get("X-OmniSci-Backend"); got != "" {
+		t.Errorf("X-OmniSci-Backend %q sent while disabled", got)
+	}
+}
+
+func TestResponseMultiWriterClientFailure(t *testing.T) {
+	var tee bytes.Buffer
+	client := &discardResponseWriter{failAfter: 10}
+	mw := &ResponseMultiWriter{Writer: &tee, ResponseWriter: client}
+
+	n, err := mw.Write([]byte("0123456789abcdefghij"))
+	if n != 10 || err == nil {
+		t.Errorf("Write returned %d, %v; want the client's 10 and its error", n, err)
+	}
+	if tee.String() != "0123456789" {
+		t.Errorf("teed %q, want only what the client accepted", tee.String())
+	}
+}
+
+func TestBackendHealthProbe(t *testing.T) {
+	mb := newMockBackend(t)
+	setGlobal(t, &healthResults, make(map[string]*backendHealth))
+	setGlobal(t, &backendHealthMethod, "GET")
+	setGlobal(t, &backendHealthPath, "/status")
+	setGlobal(t, &healthCheckTimeout, time.Second)
+	target := &healthTarget{name: "backend", probe: probeBackend}
+
+	checkHealth(target)
+	if res := healthResult("backend"); res == nil || !res.Healthy {
+		t.Fatalf("backend answering 200 is %+v, want healthy", res)
+	}
+	if calls := mb.callsOf(""); len(calls) != 1 || calls[0].Path != "/status" {
+		t.Errorf("backend got %v, want a GET of /status", calls)
+	}
+
+	mb.fail("", http.StatusServiceUnavailable)
+	checkHealth(target)
+	if res := healthResult("backend"); res == nil || res.Healthy || !strings.Contains(res.Error, "503") {
+		t.Errorf("backend answering 503 is %+v, want unhealthy", res)
+	}
+
+	checkHealth(target)
+	if res := healthResult("backend"); res == nil || !res.Healthy {
+		t.Errorf("recovered backend is %+v, want healthy", res)
+	}
+
+	setGlobal(t, &backendHealthMethod, "TCP")
+	mb.Close()
+	checkHealth(target)
+	if res := healthResult("backend"); res == nil || res.Healthy {
+		t.Errorf("closed backend is %+v, want unhealthy", res)
+	}
+}
+
+func TestResumableUploadLocks(t *testing.T) {
+	newUploadFixture(t, "upload-session")
+	locked := func(location string) bool {
+		_, ok := resumableLocks.Load(strings.TrimPrefix(location, "/upload/resumable/"))
+		return ok
+	}
+	start := func() string {
+		rw := resumableRequest(t, "POST", "/upload/resumable?filename=data.csv", "", "Upload-Length", "8")
+		if rw.Code != http.StatusCreated {
+			t.Fatalf("starting an upload got %d %q", rw.Code, rw.Body.String())
+		}
+		location := rw.Header().Get("Location")
+		if rw := resumableRequest(t, "PUT", location, "a,b\n", "Content-Range", "bytes 0-3/8"); rw.Code != http.StatusNoContent {
+			t.Fatalf("first chunk got %d %q, want 204", rw.Code, rw.Body.String())
+		}
+		return location
+	}
+
+	bogus := "/upload/resumable/" + uuid.New().String()
+	if rw := resumableRequest(t, "PUT", bogus, "a,b\n", "Content-Range", "bytes 0-3/8"); rw.Code != http.StatusNotFound || locked(bogus) {
+		t.Errorf("unknown upload got %d, locked %v, want 404 without a lock", rw.Code, locked(bogus))
+	}
+
+	cancelled := start()
+	if rw := resumableRequest(t, "DELETE", cancelled, ""); rw.Code != http.StatusNoContent || locked(cancelled) {
+		t.Errorf("cancelling got %d, locked %v, want 204 without a lock", rw.Code, locked(cancelled))
+	}
+	if rw := resumableRequest(t, "HEAD", cancelled, ""); rw.Code != http.StatusNotFound {
+		t.Errorf("cancelled upload got %d, want 404", rw.Code)
+	}
+
+	abandoned := start()
+	if _, err := reapUploads(-time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if locked(abandoned) {
+		t.Error("reaped upload is still locked")
+	}
+}
+
+func TestCleanupUploads(t *testing.T) {
+	expired := newUploadFixture(t, "expired-session")
+	writeTestFile(t, filepath.Join(expired, "old.csv"), "0123456789")
+	writeTestFile(t, filepath.Join(expired, ".resumable", "chunk"), "01234")
+	old := time.Now().Add(-2 * time.Hour)
+	filepath.Walk(expired, func(path string, fi os.FileInfo, err error) error {
+		return os.Chtimes(path, old, old)
+	})
+	fresh := filepath.Join(filepath.Dir(expired), "fresh-session")
+	writeTestFile(t, filepath.Join(fresh, "new.csv"), "new")
+
+	cleanup := func(ttl string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		cleanupUploadsHandler(rw, httptest.NewRequest("POST", "/_internal/cleanup-uploads?ttl="+ttl, nil))
+		return rw
+	}
+
+	for _, ttl := range []string{"0s", "-1h", "soon"} {
+		if rw := cleanup(ttl); rw.Code != http.StatusBadRequest {
+			t.Errorf("ttl %s: status %d, want 400", ttl, rw.Code)
+		}
+	}
+
+	setGlobal(t, &readOnly, 1)
+	if rw := cleanup("1h"); rw.Code != http.StatusForbidden {
+		t.Errorf("read-only: status %d, want 403", rw.Code)
+	}
+	setGlobal(t, &readOnly, 0)
+
+	rw := cleanup("1h")
+	if rw.Code != http.StatusOK || rw.Body.String() != `{"removed":1,"bytes_freed":15}` {
+		t.Errorf("got %d %s, want one directory of 15 bytes removed", rw.Code, rw.Body.String())
+	}
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Errorf("expired upload directory is still there")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("fresh upload directory was removed: %v", err)
+	}
+}
+
+func TestSlowHealthTarget(t *testing.T) {
+	setGlobal(t, &healthResults, make(map[string]*backendHealth))
+	release := make(chan struct{})
+	var slowProbes int32
+	setGlobal(t, &healthTargets, []*healthTarget{
+		{name: "slow", probe: func() error {
+			atomic.AddInt32(&slowProbes, 1)
+			<-release
+			return nil
+		}},
+		{name: "fast", probe: func() error { return nil }},
+	})
+	// The hung probe has to finish before the globals it writes are restored
+	t.Cleanup(func() {
+		close(release)
+		healthProbes.Wait()
+	})
+
+	checkAllHealth()
+	deadline := time.Now().Add(time.Second)
+	for healthResult("fast") == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("fast target was not checked while the slow one hung")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The next round must not pile another probe onto the hung target
+	setGlobal(t, &healthResults, make(map[string]*backendHealth))
+	checkAllHealth()
+	for healthResult("fast") == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&slowProbes); n != 1 {
+		t.Errorf("slow target probed %d times at once, want 1", n)
+	}
+	if healthResult("slow") != nil {
+		t.Errorf("slow target has a result before its probe finished")
+	}
+}
+
+func TestNocacheParam(t *testing.T) {
+	newFrontendFixture(t)
+	if allowNocacheParam {
+		t.Errorf("nocache parameter allowed by default")
+	}
+
+	for _, allow := range []bool{false, true} {
+		setGlobal(t, &allowNocacheParam, allow)
+		r := httptest.NewRequest("GET", "/app.js?nocache=1", nil)
+		r.Header.Set("If-Modified-Since", time.Now().UTC().Format(http.TimeFormat))
+		rw := httptest.NewRecorder()
+		thriftOrFrontendHandler(rw, r)
+
+		noStore := rw.Header().Get("Cache-Control") == "no-store"
+		if noStore != allow {
+			t.Errorf("allowed %v: Cache-Control %q", allow, rw.Header().Get("Cache-Control"))
+		}
+		if fresh := rw.Code == http.StatusOK; fresh != allow {
+			t.Errorf("allowed %v: status %d", allow, rw.Code)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"":                      false,
+		"gzip":                  true,
+		"deflate, gzip":         true,
+		"gzip;q=0.05":           true,
+		"gzip; Q=1.0":           true,
+		"gzip;q=0":              false,
+		"gzip;q=0.000":          false,
+		"gzip;q=oops":           false,
+		"br;q=1.0, gzip;q=0.5":  true,
+		"identity, x-gzip;q=1":  false,
+		"gzip;level=9;q=0.001 ": true,
+	}
+	for header, want := range tests {
+		r := httptest.NewRequest("GET", "/version.txt", nil)
+		r.Header.Set("Accept-Encoding", header)
+		if got := acceptsGzip(r); got != want {
+			t.Errorf("Accept-Encoding %q: got %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestPolledEndpointsGzip(t *testing.T) {
+	newFrontendFixture(t)
+	tests := []struct {
+		path        string
+		handler     http.HandlerFunc
+		contentType string
+		want        string
+	}{
+		{"/servers.json", serversHandler, "application/json", `"database": "omnisci"`},
+		{"/version.txt", versionHandler, "text/plain; charset=utf-8", "Immerse:\n5.0.0-immerse"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		rw := httptest.NewRecorder()
+		tt.handler(rw, r)
+
+		h := rw.Header()
+		if h.Get("Content-Encoding") != "gzip" || h.Get("Content-Type") != tt.contentType {
+			t.Errorf("%s: Content-Encoding %q, Content-Type %q", tt.path, h.Get("Content-Encoding"), h.Get("Content-Type"))
+			continue
+		}
+		zr, err := gzip.NewReader(rw.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		body, _ := ioutil.ReadAll(zr)
+		if !strings.Contains(string(body), tt.want) {
+			t.Errorf("%s: decompressed body %q lacks %q", tt.path, body, tt.want)
+		}
+	}
+}
+
+func TestUnknownInternalPath(t *testing.T) {
+	newFrontendFixture(t)
+	mux, _ := newMuxes()
+
+	rw := httptest.NewRecorder()
+	mux.ServeHTTP(rw, httptest.NewRequest("GET", "/_internal/foo", nil))
+	if rw.Code != http.StatusNotFound || rw.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d %q, want a JSON 404", rw.Code, rw.Header().Get("Content-Type"))
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil || body["error"] == "" {
+		t.Errorf("body %q is not a JSON error", rw.Body.String())
+	}
+
+	for _, path := range []string{serversJSONSetPath, "/_internal/clear-servers-json"} {
+		if _, pattern := mux.Handler(httptest.NewRequest("GET", path, nil)); pattern != path {
+			t.Errorf("%s is served by %q", path, pattern)
+		}
+	}
+}
+
+func TestStaticMount(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "logo.svg"), "<svg/>")
+	writeTestFile(t, filepath.Join(dir, "index.html"), "tour")
+
+	for _, spa := range []bool{false, true} {
+		sm := &staticMount{"/branding/", dir, spa}
+		rw := httptest.NewRecorder()
+		sm.staticHandler(rw, httptest.NewRequest("GET", "/branding/logo.svg", nil))
+		if rw.Code != http.StatusOK || rw.Body.String() != "<svg/>" {
+			t.Errorf("spa %v: got %d %q, want the mounted file", spa, rw.Code, rw.Body.String())
+		}
+
+		rw = httptest.NewRecorder()
+		sm.staticHandler(rw, httptest.NewRequest("GET", "/branding/step/2", nil))
+		if served := rw.Code == http.StatusOK && rw.Body.String() == "tour"; served != spa {
+			t.Errorf("spa %v: unknown path got %d %q", spa, rw.Code, rw.Body.String())
+		}
+	}
+}
+
+func TestCheckPaths(t *testing.T) {
+	target, _ := url.Parse("http://localhost:9000")
+	tests := []struct {
+		proxies []reverseProxy
+		mounts  []staticMount
+		ok      bool
+	}{
+		{[]reverseProxy{{"/api/", target, nil}}, []staticMount{{"/branding/", "/srv", false}}, true},
+		{nil, []staticMount{{"/", "/srv", false}}, false},
+		{nil, []staticMount{{"/docs/", "/srv", false}}, false},
+		{nil, []staticMount{{"/metrics/", "/srv", false}}, false},
+		{nil, []staticMount{{"/branding/", "/srv", false}, {"/branding/", "/other", false}}, false},
+		{[]reverseProxy{{"/branding/", target, nil}}, []staticMount{{"/branding/", "/srv", false}}, false},
+		{[]reverseProxy{{"/", target, nil}}, nil, false},
+	}
+	for _, tt := range tests {
+		setGlobal(t, &proxies, tt.proxies)
+		setGlobal(t, &staticMounts, tt.mounts)
+		if err := checkPaths(); (err == nil) != tt.ok {
+			t.Errorf("proxies %v, mounts %v: got %v", tt.proxies, tt.mounts, err)
+		}
+	}
+
+	setGlobal(t, &proxies, []reverseProxy{{"/api/", target, nil}})
+	setGlobal(t, &staticMounts, nil)
+	for path, ok := range map[string]bool{"/_internal/set-servers-json": true, "/": false, "/servers.json": false, "/api/": false} {
+		setGlobal(t, &serversJSONSetPath, path)
+		if err := checkPaths(); (err == nil) != ok {
+			t.Errorf("servers.json set path %s: got %v", path, err)
+		}
+	}
+	setGlobal(t, &disableServersJSON, true)
+	if err := checkPaths(); err != nil {
+		t.Errorf("unused servers.json set path refused: %v", err)
+	}
+}
+
+func TestBuiltinPathsRegistered(t *testing.T) {
+	setGlobal(t, &profile, true)
+	setGlobal(t, &separateAdmin, false)
+	mux, _ := newMuxes()
+	for path := range builtinPaths {
+		if _, pattern := mux.Handler(httptest.NewRequest("GET", path, nil)); pattern != path {
+			t.Errorf("built-in path %s is served by %q", path, pattern)
+		}
+	}
+}
+
+func TestBackendUpGauge(t *testing.T) {
+	useMetrics(t)
+	setGlobal(t, &healthResults, make(map[string]*backendHealth))
+	var probeErr error
+	target := &healthTarget{name: "backend", probe: func() error { return probeErr }}
+	// Probed directly, so that each result is in before the gauge is read
+	setGlobal(t, &healthTargets, []*healthTarget{target})
+
+	for _, err := range []error{nil, errors.New("connection refused"), nil} {
+		probeErr = err
+		checkHealth(target)
+		g, ok := registry.Get("backend_up.backend").(metrics.Gauge)
+		if want := map[bool]int64{true: 1, false: 0}[err == nil]; !ok || g.Value() != want {
+			t.Errorf("probe error %v: backend_up.backend is %v, want %d", err, g, want)
+		}
+	}
+}
+
+func TestThriftPostToRootNotIntercepted(t *testing.T) {
+	mb := newMockBackend(t)
+	newFrontendFixture(t)
+	h := thriftTimingHandler(http.HandlerFunc(thriftOrFrontendHandler))
+
+	// A Thrift call whose query happens to look like servers.json overrides
+	call := `[1,"sql_execute",1,0,{"1":{"str":"` + mockSessionID + `"},"2":{"str":"SELECT 1 WHERE username=1&database=2"}}]`
+	r := newThriftRequest(call)
+	r.URL.RawQuery = "username=bob"
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, r)
+
+	if rw.Code != http.StatusOK {
+		t.Errorf("status %d to %q, want the backend's response", rw.Code, rw.Header().Get("Location"))
+	}
+	if calls := mb.callsOf("sql_execute"); len(calls) != 1 || calls[0].Body != call {
+		t.Errorf("backend got %v, want the call unchanged", calls)
+	}
+}
+
+func TestCheckFrontendIndex(t *testing.T) {
+	dir := newFrontendFixture(t)
+	logged := captureLog(t)
+
+	for _, required := range []bool{false, true} {
+		setGlobal(t, &frontendRequired, required)
+		if exitsFatally(t, checkFrontendIndex) || logged.Len() > 0 {
+			t.Errorf("required %v: complete frontend refused: %s", required, logged)
+		}
+	}
+
+	os.Remove(filepath.Join(dir, "beta", "index.html"))
+	for _, required := range []bool{false, true} {
+		logged.Reset()
+		setGlobal(t, &frontendRequired, required)
+		if fatal := exitsFatally(t, checkFrontendIndex); fatal != required {
+			t.Errorf("required %v: fatal %v", required, fatal)
+		}
+		if !strings.Contains(logged.String(), "beta/index.html") {
+			t.Errorf("required %v: logged %q, want the missing beta index", required, logged)
+		}
+	}
+}
+
+// startTracing points the span exporter at a collector for the rest of the
+// test, and returns the bodies of the export requests it receives.
+func startTracing(t *testing.T) <-chan []byte {
+	t.Helper()
+	exports := make(chan []byte, 16)
+	collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		exports <- body
+	}))
+	t.Cleanup(collector.Close)
+	setGlobal(t, &otelEndpoint, collector.URL+"/v1/traces")
+	setGlobal(t, &spanQueue, make(chan *traceSpan, 16))
+	stop, done := make(chan struct{}), make(chan struct{})
+	setGlobal(t, &spanStop, stop)
+	setGlobal(t, &spanDone, done)
+	go exportSpans()
+	// The exporter has to be gone before the globals it reads are restored
+	t.Cleanup(func() {
+		select {
+		case <-stop:
+		default:
+			close(stop)
+		}
+		<-done
+	})
+	return exports
+}
+
+// exportedSpans stops the exporter and returns the spans it sent, by name.
+func exportedSpans(t *testing.T, exports <-chan []byte) map[string]map[string]interface{} {
+	t.Helper()
+	stopSpans(time.Second)
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []map[string]interface{}
+			}
+		}
+	}
+	select {
+	case body := <-exports:
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Fatalf("collector got invalid OTLP/JSON %q: %v", body, err)
+		}
+	default:
+		t.Fatal("nothing was exported")
+	}
+	spans := make(map[string]map[string]interface{})
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				spans[fmt.Sprint(s["kind"])+" "+fmt.Sprint(s["name"])] = s
+			}
+		}
+	}
+	return spans
+}
+
+func TestTracingThriftCall(t *testing.T) {
+	mb := newMockBackend(t)
+	exports := startTracing(t)
+
+	// The method name is found without buffering the whole call
+	body := `[1,"sql_execute",1,0,{"1":{"str":"` + mockSessionID + `"},"2":{"str":"SELECT '` + strings.Repeat("x", 4*thriftMethodScanBytes) + `'"}}]`
+	r := newThriftRequest(body)
+	r.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	rw := httptest.NewRecorder()
+	tracingHandler(newBackendProxy(backendURL)).ServeHTTP(rw, r)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rw.Code)
+	}
+	calls := mb.callsOf("sql_execute")
+	if len(calls) != 1 || calls[0].Body != body {
+		t.Fatalf("backend got %v, want the whole call", calls)
+	}
+	parent := parseTraceparent(calls[0].Header.Get("traceparent"))
+	if parent == nil || hex.EncodeToString(parent.traceID[:]) != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("backend got traceparent %q, want the caller's trace", calls[0].Header.Get("traceparent"))
+	}
+
+	spans := exportedSpans(t, exports)
+	server, client := spans["2 sql_execute"], spans["3 sql_execute"]
+	if server == nil || client == nil {
+		t.Fatalf("exported spans %v, want a server and a client sql_execute span", spans)
+	}
+	if server["traceId"] != "0af7651916cd43dd8448eb211c80319c" || server["parentSpanId"] != "b7ad6b7169203331" {
+		t.Errorf("server span %v doesn't continue the caller's trace", server)
+	}
+	if client["parentSpanId"] != server["spanId"] || client["spanId"] != hex.EncodeToString(parent.spanID[:]) {
+		t.Errorf("client span %v isn't the child of %v passed to the backend", client, server)
+	}
+}
+
+func TestTracingProxyAndSAMLConnect(t *testing.T) {
+	mb := newMockBackend(t)
+	exports := startTracing(t)
+
+	rp := reverseProxy{Path: "/proxy/", Target: backendURL}
+	r := httptest.NewRequest("GET", "/proxy/status", nil)
+	tracingHandler(http.HandlerFunc(rp.proxyHandler)).ServeHTTP(httptest.NewRecorder(), r)
+
+	parent := newSpan("connect", spanKindServer, nil)
+	ctx := context.WithValue(context.Background(), spanContextKey{}, parent)
+	resp, err := samlConnect(ctx, []byte(thriftCall("connect", "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	mb.mu.Lock()
+	calls := mb.calls
+	mb.mu.Unlock()
+	if len(calls) != 2 {
+		t.Fatalf("backend got %d calls, want 2", len(calls))
+	}
+	for _, c := range calls {
+		if parseTraceparent(c.Header.Get("traceparent")) == nil {
+			t.Errorf("backend call to %s got no trace context", c.Path)
+		}
+	}
+	if s := parseTraceparent(calls[1].Header.Get("traceparent")); s != nil && s.traceID != parent.traceID {
+		t.Error("SAML connect isn't part of the login's trace")
+	}
+
+	spans := exportedSpans(t, exports)
+	if spans["3 HTTP GET"] == nil || spans["3 connect"] == nil {
+		t.Errorf("exported spans %v, want client spans for both backend calls", spans)
+	}
+}
+
+func TestUploadFileLimitWhileStreaming(t *testing.T) {
+	uploadDir := newUploadFixture(t, "upload-session")
+	setGlobal(t, &maxUploadFiles, 2)
+
+	// The body never ends, so the limit must be enforced on the third file
+	// rather than after the whole form has been read.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		for _, name := range []string{"a.csv", "b.csv", "c.csv"} {
+			fw, _ := mw.CreateFormFile("file", name)
+			fw.Write([]byte("a,b\n1,2\n"))
+		}
+		mw.CreateFormFile("file", "d.csv")
+	}()
+
+	r := httptest.NewRequest("POST", "/upload", pr)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("sessionid", "upload-session")
+	rw := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		uploadHandler(rw, r)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload with too many files was read to the end")
+	}
+
+	if rw.Code != http.StatusBadRequest || !strings.Contains(rw.Body.String(), "limit 2") {
+		t.Errorf("got %d %q, want 400 naming the limit", rw.Code, rw.Body.String())
+	}
+	if entries, _ := ioutil.ReadDir(uploadDir); len(entries) != 0 {
+		t.Errorf("rejected upload left %d files behind", len(entries))
+	}
+}
+
+func TestReadUploadForm(t *testing.T) {
+	setGlobal(t, &maxUploadFiles, 2)
+	body, ct := multipartBody(t, map[string]string{"small.csv": "a,b\n", "large.csv": strings.Repeat("1,2\n", 64)}, map[string]string{"sessionid": "upload-session"})
+	r := httptest.NewRequest("POST", "/upload?sha256=abc", body)
+	r.Header.Set("Content-Type", ct)
+
+	parts, err := readUploadForm(r, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.FormValue("sessionid") != "upload-session" || r.FormValue("sha256") != "abc" || r.PostFormValue("sha256") != "" {
+		t.Errorf("form %v, post form %v don't hold the fields and query", r.Form, r.PostForm)
+	}
+	if len(parts) != 2 {
+		t.Fatalf("got %d files, want 2", len(parts))
+	}
+	var spooled string
+	for _, p := range parts {
+		f, err := p.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(f)
+		f.Close()
+		if want := map[string]int{"small.csv": 4, "large.csv": 256}[p.Filename]; len(b) != want {
+			t.Errorf("%s has %d bytes, want %d", p.Filename, len(b), want)
+		}
+		if p.tmpfile != "" {
+			spooled = p.Filename + " " + p.tmpfile
+		}
+	}
+	if !strings.HasPrefix(spooled, "large.csv ") {
+		t.Fatalf("spooled %q, want only large.csv on disk", spooled)
+	}
+
+	removeUploadParts(parts)
+	if _, err := os.Stat(strings.TrimPrefix(spooled, "large.csv ")); !os.IsNotExist(err) {
+		t.Error("spooled file was not removed")
+	}
+}
+
+func TestUploadChecksum(t *testing.T) {
+	uploadDir := newUploadFixture(t, "upload-session")
+	content := "a,b\n1,2\n"
+	sum := sha256.Sum256([]byte(content))
+	good := hex.EncodeToString(sum[:])
+
+	upload := func(files map[string]string, fields map[string]string, header string) *httptest.ResponseRecorder {
+		body, ct := multipartBody(t, files, fields)
+		r := httptest.NewRequest("POST", "/upload", body)
+		r.Header.Set("Content-Type", ct)
+		r.Header.Set("sessionid", "upload-session")
+		if header != "" {
+			r.Header.Set("X-Upload-SHA256", header)
+		}
+		rw := httptest.NewRecorder()
+		uploadHandler(rw, r)
+		return rw
+	}
+
+	for _, tc := range []struct {
+		name   string
+		files  map[string]string
+		fields map[string]string
+		header string
+		want   int
+	}{
+		{"field", map[string]string{"a.csv": content}, map[string]string{"sha256": strings.ToUpper(good)}, "", http.StatusOK},
+		{"header", map[string]string{"a.csv": content}, nil, good, http.StatusOK},
+		{"per file", map[string]string{"a.csv": content, "b.csv": "x"}, map[string]string{"sha256:a.csv": good}, "", http.StatusOK},
+		{"mismatch", map[string]string{"a.csv": content + "3,4\n"}, map[string]string{"sha256": good}, "", http.StatusUnprocessableEntity},
+		{"plain field with several files", map[string]string{"a.csv": content, "b.csv": "x"}, map[string]string{"sha256": good}, "", http.StatusOK},
+	} {
+		os.RemoveAll(uploadDir)
+		if rw := upload(tc.files, tc.fields, tc.header); rw.Code != tc.want {
+			t.Errorf("%s: got %d %q, want %d", tc.name, rw.Code, rw.Body.String(), tc.want)
+		}
+		if tc.want != http.StatusOK {
+			if _, err := os.Stat(filepath.Join(uploadDir, "a.csv")); !os.IsNotExist(err) {
+				t.Errorf("%s: file failing its checksum was kept", tc.name)
+			}
+		}
+	}
+}
+
+func TestParseReverseProxy(t *testing.T) {
+	for _, tc := range []struct {
+		in, path, target string
+	}{
+		{"/api=http://[::1]:8080/v1", "/api/", "http://[::1]:8080/v1"},
+		{"/api/=http://[fe80::1%25eth0]:8080", "/api/", "http://[fe80::1%25eth0]:8080"},
+		{"/api/:http://localhost:8080", "/api/", "http://localhost:8080"},
+		{"/api:http://[::1]:8080", "/api/", "http://[::1]:8080"},
+		{"/q=http://host:9000/search?a=b", "/q/", "http://host:9000/search?a=b"},
+	} {
+		p, err := parseReverseProxy(tc.in)
+		if err != nil {
+			t.Errorf("%s: %v", tc.in, err)
+			continue
+		}
+		if p.Path != tc.path || p.Target.String() != tc.target {
+			t.Errorf("%s: got %s -> %s, want %s -> %s", tc.in, p.Path, p.Target, tc.path, tc.target)
+		}
+	}
+
+	for _, in := range []string{"/api", "=http://host", "/api=host:8080", "/api=http://", "/api=http://[::1"} {
+		if _, err := parseReverseProxy(in); err == nil {
+			t.Errorf("%s: parsed, want an error", in)
+		}
+	}
+}
+
+func TestEndpointPolicyMatchesSegments(t *testing.T) {
+	defaults := make(map[string]bool)
+	for _, ep := range defaultEndpointPolicies {
+		defaults[ep.Prefix] = ep.MaxConcurrency > 0
+	}
+	for _, prefix := range []string{"/", "/upload", "/upload/resumable", "/metrics/"} {
+		if !defaults[prefix] {
+			t.Errorf("no default concurrency limit for %s", prefix)
+		}
+	}
+
+	for _, tc := range []struct {
+		prefix, path string
+		want         bool
+	}{
+		{"/upload", "/upload", true},
+		{"/upload", "/upload/resumable", true},
+		{"/upload", "/uploads-foo", false},
+		{"/upload", "/uploadx", false},
+		{"/metrics/", "/metrics/", true},
+		{"/metrics/", "/metrics/json", true},
+		{"/metrics/", "/metrics", false},
+		{"/", "/", true},
+		{"/", "/app.js", false},
+	} {
+		ep := &endpointPolicy{Prefix: tc.prefix}
+		if got := ep.matches(tc.path); got != tc.want {
+			t.Errorf("%s matches %s: %v, want %v", tc.prefix, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestEndpointPolicyLimits(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	h := endpointPolicyHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/upload":
+			close(started)
+			<-release
+		case "/saml-post":
+			if _, err := ioutil.ReadAll(r.Body); err != nil {
+				http.Error(rw, err.Error(), http.StatusRequestEntityTooLarge)
+			}
+		case "/slow":
+			<-r.Context().Done()
+			http.Error(rw, r.Context().Err().Error(), http.StatusGatewayTimeout)
+		}
+	}))
+	setGlobal(t, &endpointPolicies, []*endpointPolicy{
+		{Prefix: "/upload", MaxConcurrency: 1, slots: make(chan struct{}, 1)},
+		{Prefix: "/saml-post", MaxBodySize: 8},
+		{Prefix: "/slow", Timeout: 50 * time.Millisecond},
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", nil))
+	}()
+	// The upload has to be done with the policies before they are restored
+	t.Cleanup(func() {
+		close(release)
+		wg.Wait()
+	})
+	<-started
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("POST", "/upload", nil))
+	if rw.Code != http.StatusServiceUnavailable || rw.Header().Get("Retry-After") == "" {
+		t.Errorf("upload over the concurrency limit got %d, want 503 with Retry-After", rw.Code)
+	}
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("POST", "/uploads-foo", nil))
+	if rw.Code != http.StatusOK {
+		t.Errorf("/uploads-foo got %d, want the /upload policy not to apply", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("POST", "/saml-post", strings.NewReader("0123456789")))
+	if rw.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body got %d, want 413", rw.Code)
+	}
+	r := httptest.NewRequest("POST", "/saml-post", strings.NewReader("0123456789"))
+	r.ContentLength = -1
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, r)
+	if rw.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized chunked body got %d, want 413", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("GET", "/slow", nil))
+	if rw.Code != http.StatusGatewayTimeout {
+		t.Errorf("slow request got %d, want its context to time out", rw.Code)
+	}
+}
+
+func TestReverseProxyCORS(t *testing.T) {
+	target, _ := url.Parse("http://localhost:9000")
+	setGlobal(t, &proxies, []reverseProxy{
+		{"/api/", target, proxyCORS{Path: "/api/", AllowedOrigins: []string{"https://a.example.com"}, AllowCredentials: true, MaxAge: 60}.handler()},
+		{"/other/", target, nil},
+	})
+	global := cors.New(cors.Options{AllowedHeaders: corsAllowedHeaders, AllowedMethods: corsAllowedMethods, MaxAge: corsMaxAge})
+	h := corsHandler(global, http.NewServeMux())
+
+	preflight := func(path, origin string) http.Header {
+		r := httptest.NewRequest("OPTIONS", path, nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", "POST")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, r)
+		return rw.Header()
+	}
+
+	if hdr := preflight("/api/query", "https://a.example.com"); hdr.Get("Access-Control-Allow-Origin") != "https://a.example.com" ||
+		hdr.Get("Access-Control-Allow-Credentials") != "true" || hdr.Get("Access-Control-Max-Age") != "60" {
+		t.Errorf("route's own origin got %v, want its CORS options", hdr)
+	}
+	if hdr := preflight("/api/query", "https://b.example.com"); hdr.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("other origin allowed on the route: %v", hdr)
+	}
+	if hdr := preflight("/other/query", "https://b.example.com"); hdr.Get("Access-Control-Allow-Origin") == "" || hdr.Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("route without CORS options got %v, want the global ones", hdr)
+	}
+}
+
+// readRecorder is a request body that records whether it was read.
+type readRecorder struct {
+	io.Reader
+	read bool
+}
+
+func (rr *readRecorder) Read(p []byte) (int, error) {
+	rr.read = true
+	return rr.Reader.Read(p)
+}
+
+func TestReadOnlyUploadRejectedUnread(t *testing.T) {
+	newUploadFixture(t, "upload-session")
+	setGlobal(t, &readOnly, int32(1))
+
+	for _, expect := range []string{"", "100-continue"} {
+		body, ct := multipartBody(t, map[string]string{"data.csv": "a,b\n1,2\n"}, nil)
+		rr := &readRecorder{Reader: body}
+		r := httptest.NewRequest("POST", "/upload", rr)
+		r.Header.Set("Content-Type", ct)
+		r.Header.Set("sessionid", "upload-session")
+		if expect != "" {
+			r.Header.Set("Expect", expect)
+		}
+		rw := httptest.NewRecorder()
+		uploadHandler(rw, r)
+
+		if rw.Code != http.StatusUnauthorized {
+			t.Errorf("Expect %q: got %d, want 401", expect, rw.Code)
+		}
+		if rr.read {
+			t.Errorf("Expect %q: body of a rejected upload was read", expect)
+		}
+	}
+}
+
+func TestEventStreamsProxiedIncrementally(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(rw, "data: first\n\n")
+		rw.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		fmt.Fprint(rw, "data: second\n\n")
+	}))
+	defer upstream.Close()
+	defer close(release)
+	target, _ := url.Parse(upstream.URL)
+
+	rp := reverseProxy{Path: "/events/", Target: target}
+	for name, h := range map[string]http.Handler{
+		"reverse proxy": http.HandlerFunc(rp.proxyHandler),
+		"backend proxy": newBackendProxy(target),
+	} {
+		srv := httptest.NewServer(compressHandler(h))
+		r, _ := http.NewRequest("GET", srv.URL+"/events/stream", nil)
+		r.Header.Set("Accept", "text/event-stream")
+		r.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		line := make(chan string, 1)
+		go func() {
+			l, _ := bufio.NewReader(resp.Body).ReadString('\n')
+			line <- l
+		}()
+		select {
+		case l := <-line:
+			if l != "data: first\n" {
+				t.Errorf("%s: got %q, want the first event uncompressed", name, l)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: first event held back until the stream ends", name)
+		}
+		resp.Body.Close()
+		srv.Close()
+	}
+}
+
+func TestFailoverToFallbackBackend(t *testing.T) {
+	fallback := newMockBackend(t)
+	fallbackURL := backendURL
+	primary := newMockBackend(t)
+	newFrontendFixture(t)
+	setGlobal(t, &fallbackBackendURL, fallbackURL)
+	setGlobal(t, &healthResults, make(map[string]*backendHealth))
+
+	var primaryErr, fallbackErr error
+	targets := []*healthTarget{
+		{name: "backend", probe: func() error { return primaryErr }},
+		{name: "fallback", probe: func() error { return fallbackErr }},
+	}
+	query := func() string {
+		rw := httptest.NewRecorder()
+		thriftOrFrontendHandler(rw, newThriftRequest(thriftCall("sql_execute", mockSessionID)))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("status %d, want 200", rw.Code)
+		}
+		return rw.Header().Get("X-OmniSci-Failover")
+	}
+
+	for _, tc := range []struct {
+		primaryErr, fallbackErr error
+		wantFallback            bool
+	}{
+		{nil, nil, false},
+		{errors.New("connection refused"), nil, true},
+		{errors.New("connection refused"), errors.New("connection refused"), false},
+		{nil, nil, false},
+	} {
+		primaryErr, fallbackErr = tc.primaryErr, tc.fallbackErr
+		for _, ht := range targets {
+			checkHealth(ht)
+		}
+		nprimary, nfallback := len(primary.callsOf("sql_execute")), len(fallback.callsOf("sql_execute"))
+		header := query()
+
+		gotFallback := len(fallback.callsOf("sql_execute")) > nfallback
+		if gotFallback != tc.wantFallback || len(primary.callsOf("sql_execute")) > nprimary == tc.wantFallback {
+			t.Errorf("primary %v, fallback %v: went to the fallback %v, want %v", tc.primaryErr, tc.fallbackErr, gotFallback, tc.wantFallback)
+		}
+		if (header == "fallback") != tc.wantFallback {
+			t.Errorf("primary %v, fallback %v: X-OmniSci-Failover %q", tc.primaryErr, tc.fallbackErr, header)
+		}
+	}
+}
+
+func TestStatusPageHidesBackendError(t *testing.T) {
+	logs := captureLog(t)
+	setGlobal(t, &healthResults, map[string]*backendHealth{
+		"backend": {Target: "backend", Error: "dial tcp 10.1.2.3:6278: connection refused", Checked: time.Now()},
+	})
+
+	rw := httptest.NewRecorder()
+	statusPageHandler(rw, httptest.NewRequest("GET", "/", nil))
+
+	if !strings.Contains(rw.Body.String(), "Backend unreachable,") {
+		t.Errorf("status page %q doesn't say the backend is unreachable", rw.Body.String())
+	}
+	if strings.Contains(rw.Body.String(), "10.1.2.3") {
+		t.Errorf("status page shows the backend error: %q", rw.Body.String())
+	}
+	if !strings.Contains(logs.String(), "10.1.2.3:6278: connection refused") {
+		t.Errorf("backend error not logged: %q", logs.String())
+	}
+}
+
+func TestMIMEOverrides(t *testing.T) {
+	dir := newFrontendFixture(t)
+	writeTestFile(t, filepath.Join(dir, "render.wasm"), "\x00asm\x01\x00\x00\x00")
+	writeTestFile(t, filepath.Join(dir, "worker.mjs"), "export default 1")
+
+	for path, want := range map[string]string{
+		"/render.wasm": "application/wasm",
+		"/worker.mjs":  "text/javascript",
+	} {
+		rw := httptest.NewRecorder()
+		thriftOrFrontendHandler(rw, httptest.NewRequest("GET", path, nil))
+		if got := rw.Header().Get("Content-Type"); !strings.HasPrefix(got, want) {
+			t.Errorf("%s served as %q, want %s", path, got, want)
+		}
+	}
+}
+
+func BenchmarkHasCustomServersJSONParams(b *testing.B) {
+	thrift := []byte(`[1,"sql_execute",1,0,{"1":{"str":"` + mockSessionID + `"},"2":{"str":"SELECT '` + strings.Repeat("x", 1<<20) + `'"}}]`)
+	form := []byte("username=admin&database=omnisci")
+	large := []byte("q=" + strings.Repeat("x", 1<<20))
+
+	for _, bc := range []struct {
+		name, ct string
+		body     []byte
+	}{
+		{"thrift", "application/vnd.apache.thrift.json", thrift},
+		{"form", "application/x-www-form-urlencoded", form},
+		{"large form", "application/x-www-form-urlencoded", large},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(bc.body)))
+			body := bytes.NewReader(bc.body)
+			for i := 0; i < b.N; i++ {
+				body.Reset(bc.body)
+				r := httptest.NewRequest("POST", "/", body)
+				r.Header.Set("Content-Type", bc.ct)
+				hasCustomServersJSONParams(r)
+				io.Copy(ioutil.Discard, r.Body)
+			}
+		})
+	}
+}
+
+func TestBetaRequireCookie(t *testing.T) {
+	newFrontendFixture(t)
+
+	get := func(cookie bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/beta/", nil)
+		if cookie {
+			r.AddCookie(&http.Cookie{Name: betaCookieName, Value: "true"})
+		}
+		rw := httptest.NewRecorder()
+		betaOrRedirectFrontendHandler(rw, r)
+		return rw
+	}
+
+	setGlobal(t, &betaRequireCookie, true)
+	if rw := get(false); rw.Code != http.StatusTemporaryRedirect || rw.Header().Get("Location") != "/" {
+		t.Errorf("beta without the cookie got %d to %q, want a redirect to /", rw.Code, rw.Header().Get("Location"))
+	}
+	if rw := get(true); rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), "beta") {
+		t.Errorf("beta with the cookie got %d %q", rw.Code, rw.Body.String())
+	}
+
+	setGlobal(t, &betaRequireCookie, false)
+	if rw := get(false); rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), "beta") {
+		t.Errorf("open beta without the cookie got %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestForgedSAMLFlagIgnored(t *testing.T) {
+	mb := newMockBackend(t)
+	newFrontendFixture(t)
+
+	for name, sig := range map[string]*http.Cookie{
+		"no signature":      nil,
+		"bad signature":     {Name: samlSignatureCookieName, Value: strings.Repeat("0", 64)},
+		"other session's":   {Name: samlSignatureCookieName, Value: samlSignature("another-session")},
+		"signature as flag": {Name: samlSignatureCookieName, Value: "true"},
+	} {
+		r := newThriftRequest(thriftCall("sql_execute", samlPlaceholderSessionID))
+		r.AddCookie(&http.Cookie{Name: thriftSessionCookieName, Value: mockSessionID})
+		r.AddCookie(&http.Cookie{Name: samlAuthCookieName, Value: "true"})
+		if sig != nil {
+			r.AddCookie(sig)
+		}
+		if _, ok := samlSessionID(r); ok {
+			t.Errorf("%s: SAML session honored", name)
+		}
+		thriftOrFrontendHandler(httptest.NewRecorder(), r)
+	}
+
+	for _, c := range mb.callsOf("sql_execute") {
+		if strings.Contains(c.Body, mockSessionID) {
+			t.Errorf("forged flag got the session swapped in: %s", c.Body)
+		}
+	}
+}
+
+func TestSAMLPostBackendUnavailable(t *testing.T) {
+	mb := newMockBackend(t)
+	setGlobal(t, &samlConnectRetries, 1)
+
+	login := func() *httptest.ResponseRecorder {
+		form := url.Values{"SAMLResponse": {"PHNhbWxwOlJlc3BvbnNlPg=="}}
+		r := httptest.NewRequest("POST", "/saml-post", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		samlPostHandler(rw, r)
+		return rw
+	}
+
+	mb.fail("connect", http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	if rw := login(); rw.Header().Get("Location") != samlErrorPage+"?reason=backend-unavailable" {
+		t.Errorf("restarting backend sent the user to %q", rw.Header().Get("Location"))
+	}
+	if n := len(mb.callsOf("connect")); n != 2 {
+		t.Errorf("backend got %d connect calls, want 2", n)
+	}
+
+	mb.Close()
+	if rw := login(); rw.Header().Get("Location") != samlErrorPage+"?reason=backend-unavailable" {
+		t.Errorf("unreachable backend sent the user to %q", rw.Header().Get("Location"))
+	}
+}
+
+func TestUnreadyStatusAndBody(t *testing.T) {
+	setGlobal(t, &healthResults, map[string]*backendHealth{
+		"backend": {Target: "backend", Error: `dial "tcp": connection refused`, Checked: time.Now()},
+	})
+	body, err := parseUnreadyBody(`{"state":"down","why":{{json .Error}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGlobal(t, &unreadyStatus, http.StatusTooManyRequests)
+	setGlobal(t, &unreadyBody, body)
+
+	rw := httptest.NewRecorder()
+	readyHandler(rw, httptest.NewRequest("GET", "/readyz", nil))
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("status %d, want the configured 429", rw.Code)
+	}
+	var got map[string]string
+	if err := json.Unmarshal(rw.Body.Bytes(), &got); err != nil || got["state"] != "down" || got["why"] != `dial "tcp": connection refused` {
+		t.Errorf("body %q, want the configured template: %v", rw.Body.String(), err)
+	}
+
+	healthResults["backend"] = &backendHealth{Target: "backend", Healthy: true, Checked: time.Now()}
+	rw = httptest.NewRecorder()
+	readyHandler(rw, httptest.NewRequest("GET", "/readyz", nil))
+	if rw.Code != http.StatusOK || strings.Contains(rw.Body.String(), "down") {
+		t.Errorf("ready backend got %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestGzippedBackendResponse(t *testing.T) {
+	newFrontendFixture(t)
+	setGlobal(t, &compress, false)
+	reply := sqlExecuteResponse(7, 21)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(reply))
+	zw.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/vnd.apache.thrift.json")
+		rw.Header().Set("Content-Encoding", "gzip")
+		rw.Write(gz.Bytes())
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+	setGlobal(t, &backendURL, u)
+
+	for _, acceptGzip := range []bool{true, false} {
+		useMetrics(t)
+		r := newThriftRequest(thriftCall("sql_execute", mockSessionID))
+		if acceptGzip {
+			r.Header.Set("Accept-Encoding", "gzip")
+		}
+		rw := httptest.NewRecorder()
+		thriftTimingHandler(http.HandlerFunc(thriftOrFrontendHandler)).ServeHTTP(rw, r)
+
+		if acceptGzip {
+			if rw.Header().Get("Content-Encoding") != "gzip" || !bytes.Equal(rw.Body.Bytes(), gz.Bytes()) {
+				t.Errorf("client accepting gzip got %q encoded %q, want it passed through", rw.Body.String(), rw.Header().Get("Content-Encoding"))
+			}
+		} else if rw.Header().Get("Content-Encoding") != "" || rw.Body.String() != reply {
+			t.Errorf("client not accepting gzip got %q encoded %q, want it decompressed", rw.Body.String(), rw.Header().Get("Content-Encoding"))
+		}
+		// The metrics tee sees the decompressed response either way
+		if got := time.Duration(waitForTimer(t, "sql_execute.total_time_ms").Max()); got != 21*time.Millisecond {
+			t.Errorf("accept gzip %v: total time %v, want 21ms", acceptGzip, got)
+		}
+	}
+}
+
+func TestUploadContentTypes(t *testing.T) {
+	uploadDir := newUploadFixture(t, "upload-session")
+	setGlobal(t, &allowedUploadTypes, []string{"text/*"})
+
+	for name, tc := range map[string]struct {
+		content string
+		want    int
+	}{
+		"data.csv":  {"a,b\n1,2\n", http.StatusOK},
+		"image.csv": {"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", http.StatusUnsupportedMediaType},
+		"data.zip":  {"PK\x03\x04\x14\x00\x00\x00", http.StatusUnsupportedMediaType},
+	} {
+		body, ct := multipartBody(t, map[string]string{name: tc.content}, nil)
+		r := httptest.NewRequest("POST", "/upload", body)
+		r.Header.Set("Content-Type", ct)
+		r.Header.Set("sessionid", "upload-session")
+		rw := httptest.NewRecorder()
+		uploadHandler(rw, r)
+
+		if rw.Code != tc.want {
+			t.Errorf("%s: got %d %q, want %d", name, rw.Code, rw.Body.String(), tc.want)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(uploadDir, name))
+		if tc.want == http.StatusOK && string(b) != tc.content {
+			t.Errorf("%s: stored %q, want all of the sniffed data", name, b)
+		} else if tc.want != http.StatusOK && err == nil {
+			t.Errorf("%s: disallowed upload was stored", name)
+		}
+	}
+
+	for ct, want := range map[string]bool{
+		"text/plain; charset=utf-8": true,
+		"image/png":                 false,
+		"textual/plain":             false,
+	} {
+		if uploadTypeAllowed(ct) != want {
+			t.Errorf("%s allowed: %v, want %v", ct, !want, want)
+		}
+	}
+}
+
+func TestResumableUploadContentTypes(t *testing.T) {
+	uploadDir := newUploadFixture(t, "upload-session")
+	setGlobal(t, &allowedUploadTypes, []string{"text/*"})
+
+	// A tiny first chunk of an executable sniffs as text
+	exe := "\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x3e\x00"
+	for name, chunks := range map[string][]string{
+		"report.csv": {exe[:3], exe[3:]},
+		"data.csv":   {"a,", "b\n1,2\n"},
+	} {
+		total := strconv.Itoa(len(chunks[0]) + len(chunks[1]))
+		rw := resumableRequest(t, "POST", "/upload/resumable?filename="+name, "", "Upload-Length", total)
+		location := rw.Header().Get("Location")
+		var offset int
+		for _, chunk := range chunks {
+			rng := fmt.Sprintf("bytes %d-%d/%s", offset, offset+len(chunk)-1, total)
+			rw = resumableRequest(t, "PUT", location, chunk, "Content-Range", rng)
+			offset += len(chunk)
+		}
+
+		_, err := os.Stat(filepath.Join(uploadDir, name))
+		if name == "report.csv" && (rw.Code != http.StatusUnsupportedMediaType || err == nil) {
+			t.Errorf("chunked executable got %d %q, stored %v, want 415 and nothing stored", rw.Code, rw.Body.String(), err == nil)
+		}
+		if name == "data.csv" && (rw.Code != http.StatusOK || err != nil) {
+			t.Errorf("chunked CSV got %d %q, want 200 and the file stored", rw.Code, rw.Body.String())
+		}
+	}
+}
+
+func TestSAMLSwapSkipLogRateLimited(t *testing.T) {
+	logs := captureLog(t)
+	setGlobal(t, &samlSwapSkips, 0)
+	setGlobal(t, &samlSwapSkipLogged, 0)
+
+	swap := func() {
+		r := newThriftRequest(thriftCall("sql_execute", "not-a-placeholder"))
+		r.RemoteAddr = "203.0.113.7:51234"
+		replaceSessionPlaceholder(r, mockSessionID)
+		if b, _ := ioutil.ReadAll(r.Body); !strings.Contains(string(b), "not-a-placeholder") {
+			t.Fatalf("unknown session argument was replaced: %s", b)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		swap()
+	}
+	if n := strings.Count(logs.String(), "SAML session swap skipped"); n != 1 {
+		t.Fatalf("logged %d skips, want 1:\n%s", n, logs)
+	}
+	if !strings.Contains(logs.String(), "client=203.0.113.7 ") || !strings.Contains(logs.String(), "method=sql_execute") {
+		t.Errorf("log %q doesn't name the client IP and method", logs)
+	}
+
+	// A minute later the skips in between are reported with the next one
+	samlSwapSkipLogged -= int64(time.Minute)
+	swap()
+	if !strings.Contains(logs.String(), "skipped=5") {
+		t.Errorf("log %q doesn't count the unlogged skips", logs)
+	}
+}
+
+func TestMetricsSnapshotRotation(t *testing.T) {
+	useMetrics(t)
+	markMeter("upload.count", 1)
+	dump := filepath.Join(t.TempDir(), "metrics.json")
+	setGlobal(t, &metricsDumpFile, dump)
+	setGlobal(t, &metricsDumpMaxSize, 1)
+	setGlobal(t, &metricsDumpKeep, 2)
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		if err := writeMetricsSnapshot(start.Add(time.Duration(i) * time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every snapshot exceeds the size, so each file holds one of them
+	for suffix, minute := range map[string]int{"": 3, ".1": 2, ".2": 1} {
+		b, err := ioutil.ReadFile(dump + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var snap struct {
+			Time    time.Time
+			Metrics map[string]interface{}
+		}
+		if err := json.Unmarshal(b, &snap); err != nil {
+			t.Fatalf("%s holds %q: %v", dump+suffix, b, err)
+		}
+		if want := start.Add(time.Duration(minute) * time.Minute); !snap.Time.Equal(want) || snap.Metrics["upload.count"] == nil {
+			t.Errorf("%s holds the snapshot of %v with %v, want %v with upload.count", dump+suffix, snap.Time, snap.Metrics, want)
+		}
+	}
+	if _, err := os.Stat(dump + ".3"); !os.IsNotExist(err) {
+		t.Error("more than --metrics-dump-keep rotated files kept")
+	}
+}
+
+func TestServersJSONRules(t *testing.T) {
+	dir := newFrontendFixture(t)
+	newSessionStoreFixture(t)
+	internal := filepath.Join(dir, "internal.json")
+	analyst := filepath.Join(dir, "analyst.json")
+	writeTestFile(t, internal, `[{"host":"db.internal","port":6273,"database":"omnisci"}]`)
+	writeTestFile(t, analyst, `[{"host":"db.analysts","port":6273,"database":"omnisci"}]`)
+	nets, _ := parseCIDRs([]string{"10.0.0.0/8"})
+	setGlobal(t, &serversJSONRules, []serversJSONRule{
+		{CertCNs: []string{"analyst"}, File: analyst},
+		{ClientCIDRs: []string{"10.0.0.0/8"}, File: internal, nets: nets},
+	})
+
+	ca := newTestCA(t, "client CA")
+	cert := ca.issue(t, "analyst")
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+
+	for _, tc := range []struct {
+		name, remote string
+		cert         *x509.Certificate
+		host         string
+	}{
+		{"internal network", "10.1.2.3:5000", nil, "db.internal"},
+		{"analyst certificate", "10.1.2.3:5000", leaf, "db.analysts"},
+		{"anyone else", "198.51.100.1:5000", nil, "localhost"},
+	} {
+		r := httptest.NewRequest("GET", "/servers.json", nil)
+		r.RemoteAddr = tc.remote
+		if tc.cert != nil {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tc.cert}}}
+		}
+		rw := httptest.NewRecorder()
+		serversHandler(rw, r)
+		if !strings.Contains(rw.Body.String(), `"`+tc.host+`"`) {
+			t.Errorf("%s got %s, want the servers.json for %s", tc.name, rw.Body.String(), tc.host)
+		}
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	setGlobal(t, &requestIDHeader, "X-Correlation-Id")
+	var seen string
+	h := requestIDHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		seen = requestID(r)
+	}))
+
+	for id, keep := range map[string]bool{
+		"abc-123.def:456":        true,
+		"":                       false,
+		"has spaces":             false,
+		strings.Repeat("x", 129): false,
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if id != "" {
+			r.Header.Set("X-Correlation-Id", id)
+		}
+		r.Header.Set("X-Request-Id", "ignored")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, r)
+
+		got := rw.Header().Get("X-Correlation-Id")
+		if got != seen || got == "" {
+			t.Errorf("%q: echoed %q, handler saw %q", id, got, seen)
+		}
+		if (got == id) != keep {
+			t.Errorf("%q: got ID %q, want it kept %v", id, got, keep)
+		}
+		if rw.Header().Get("X-Request-Id") != "" {
+			t.Errorf("%q: default header still set", id)
+		}
+	}
+}
+
+func TestReadGzipConfig(t *testing.T) {
+	dir := t.TempDir()
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("[web]\nfrontend = \"/srv/immerse\"\n"))
+	zw.Close()
+	writeTestFile(t, filepath.Join(dir, "omnisci.toml.gz"), gz.String())
+	writeTestFile(t, filepath.Join(dir, "plain.toml.gz"), "[web]\n")
+
+	if err := readGzipConfig(filepath.Join(dir, "omnisci.toml.gz")); err != nil {
+		t.Fatal(err)
+	}
+	if got := viper.GetString("web.frontend"); got != "/srv/immerse" {
+		t.Errorf("web.frontend is %q, want the value from the compressed config", got)
+	}
+	if err := readGzipConfig(filepath.Join(dir, "plain.toml.gz")); err == nil || !strings.Contains(err.Error(), "could not decompress") {
+		t.Errorf("uncompressed file with .gz extension: got %v, want a decompression error", err)
+	}
+}
+
+func TestUploadRequiredHeader(t *testing.T) {
+	uploadDir := newUploadFixture(t, "upload-session")
+	setGlobal(t, &uploadRequiredHeader, "X-Upload-Token")
+	setGlobal(t, &uploadRequiredValue, "s3cret")
+
+	for token, want := range map[string]int{
+		"":        http.StatusForbidden,
+		"wrong":   http.StatusForbidden,
+		"s3cret!": http.StatusForbidden,
+		"s3cret":  http.StatusOK,
+	} {
+		body, ct := multipartBody(t, map[string]string{"data.csv": "a,b\n"}, nil)
+		rr := &readRecorder{Reader: body}
+		r := httptest.NewRequest("POST", "/upload", rr)
+		r.Header.Set("Content-Type", ct)
+		r.Header.Set("sessionid", "upload-session")
+		if token != "" {
+			r.Header.Set("X-Upload-Token", token)
+		}
+		rw := httptest.NewRecorder()
+		uploadHandler(rw, r)
+
+		if rw.Code != want {
+			t.Errorf("token %q: got %d, want %d", token, rw.Code, want)
+		}
+		if want == http.StatusForbidden && rr.read {
+			t.Errorf("token %q: body of a forbidden upload was read", token)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, "data.csv")); err != nil {
+		t.Errorf("upload with the token not stored: %v", err)
+	}
+}
+
+func TestSlowQueryHeader(t *testing.T) {
+	mb := newMockBackend(t)
+	setGlobal(t, &slowQueryMaxBuffer, 1<<20)
+
+	post := func(budget time.Duration) string {
+		setGlobal(t, &slowQueryBudgets, map[string]time.Duration{"sql_execute": budget})
+		rw := httptest.NewRecorder()
+		newBackendProxy(backendURL).ServeHTTP(rw, newThriftRequest(thriftCall("sql_execute", mockSessionID)))
+		if rw.Body.String() != sqlExecuteResponse(12, 34) {
+			t.Errorf("response %q is not the backend's", rw.Body.String())
+		}
+		return rw.Header().Get("X-OmniSci-Slow-Query")
+	}
+	if got := post(10 * time.Millisecond); got != "true" {
+		t.Errorf("34ms over a 10ms budget marked %q, want true", got)
+	}
+	if got := post(100 * time.Millisecond); got != "" {
+		t.Errorf("34ms within a 100ms budget marked %q", got)
+	}
+
+	// Only Thrift calls are held back to be checked
+	mb.respond("", sqlExecuteResponse(12, 34))
+	rw := httptest.NewRecorder()
+	newBackendProxy(backendURL).ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Header().Get("X-OmniSci-Slow-Query") != "" {
+		t.Error("GET response checked against the budget")
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	events := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(rw, `data: [1,"sql_execute",2,0,{}]`+"\n\n")
+		rw.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer events.Close()
+	target, _ := url.Parse(events.URL)
+	srv := httptest.NewServer(newBackendProxy(target))
+	defer srv.Close()
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(srv.URL+"/", "application/vnd.apache.thrift.json", strings.NewReader(thriftCall("sql_execute", mockSessionID)))
+	if err != nil {
+		t.Fatal("event stream held back:", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("X-OmniSci-Slow-Query") != "" {
+		t.Error("event stream checked against the budget")
+	}
+}
+
+func TestDrainWaitsOnce(t *testing.T) {
+	setGlobal(t, &draining, 0)
+	setGlobal(t, &preShutdownDelay, 100*time.Millisecond)
+	drain := newDrain()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			drain()
+		}()
+	}
+	wg.Wait()
+	drain()
+
+	if d := time.Since(start); d < preShutdownDelay || d >= 2*preShutdownDelay {
+		t.Errorf("draining four listeners took %v, want a single %v delay", d, preShutdownDelay)
+	}
+	if atomic.LoadInt32(&draining) == 0 {
+		t.Error("server not marked as draining")
+	}
+}
+
+func TestCheckListeners(t *testing.T) {
+	setGlobal(t, &port, 6273)
+	public := listenerConfig{":6273", "public", true}
+
+	for _, tc := range []struct {
+		name string
+		lcs  []listenerConfig
+		err  string
+	}{
+		{"redirect", []listenerConfig{public, {":6280", "redirect", false}, {"localhost:6279", "admin", false}}, ""},
+		{"bad handler", []listenerConfig{{":6273", "private", false}}, "Invalid listener handler"},
+		{"bad address", []listenerConfig{{"6273", "public", false}}, "Invalid listener address"},
+		{"bad port", []listenerConfig{{":70000", "public", false}}, "Invalid listener port"},
+		{"duplicate", []listenerConfig{public, public}, "Duplicate listener address"},
+		{"redirect over TLS", []listenerConfig{public, {":6280", "redirect", true}}, "must not use TLS"},
+		{"redirect on port 0", []listenerConfig{public, {":0", "redirect", false}}, "Invalid HTTP to HTTPS redirect port"},
+		{"redirect on a used port", []listenerConfig{public, {"127.0.0.1:6273", "redirect", false}}, "must use a different port"},
+		{"redirect without HTTPS", []listenerConfig{{":6273", "public", false}, {":6280", "redirect", false}}, "no public TLS listener"},
+		{"redirect to another port", []listenerConfig{{":8443", "public", true}, {":6280", "redirect", false}}, "no public TLS listener"},
+	} {
+		err := checkListeners(tc.lcs)
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: got %v, want %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestBanner(t *testing.T) {
+	newFrontendFixture(t)
+	old := bannerHTML.Load()
+	t.Cleanup(func() { bannerHTML.Store(old) })
+	setGlobal(t, &bannerEnabled, 0)
+	setGlobal(t, &separateAdmin, true)
+	setGlobal(t, &enableHTTPSAuth, false)
+	banner := `<div class="banner">Upgrade tonight</div>`
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		thriftOrFrontendHandler(rw, httptest.NewRequest("GET", path, nil))
+		return rw
+	}
+	admin := func(form url.Values) int {
+		r := httptest.NewRequest("POST", "/admin/banner", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		bannerHandler(rw, r)
+		return rw.Code
+	}
+
+	admin(url.Values{"html": {banner}, "enable": {"1"}})
+	for _, path := range []string{"/", "/dashboard/12"} {
+		rw := get(path)
+		if want := "<body>" + banner + "<div id=app>"; !strings.Contains(rw.Body.String(), want) {
+			t.Errorf("%s: page %q lacks the banner after <body>", path, rw.Body.String())
+		}
+		if rw.Header().Get("Content-Length") != strconv.Itoa(rw.Body.Len()) {
+			t.Errorf("%s: Content-Length %s for %d bytes", path, rw.Header().Get("Content-Length"), rw.Body.Len())
+		}
+	}
+	if rw := get("/app.js"); strings.Contains(rw.Body.String(), "banner") {
+		t.Errorf("banner inserted into app.js: %q", rw.Body.String())
+	}
+
+	admin(url.Values{"disable": {"1"}})
+	if rw := get("/"); strings.Contains(rw.Body.String(), "banner") {
+		t.Errorf("disabled banner still shown: %q", rw.Body.String())
+	}
+
+	// Only a POST changes the banner, and only gated admin endpoints take HTML
+	r := httptest.NewRequest("GET", "/admin/banner?html=%3Cscript%3Ealert(1)%3C%2Fscript%3E&enable=1", nil)
+	bannerHandler(httptest.NewRecorder(), r)
+	if atomic.LoadInt32(&bannerEnabled) != 0 || bannerHTML.Load().(string) != banner {
+		t.Errorf("GET changed the banner to %q", bannerHTML.Load())
+	}
+	setGlobal(t, &separateAdmin, false)
+	if code := admin(url.Values{"html": {"<script>alert(1)</script>"}}); code != http.StatusForbidden || bannerHTML.Load().(string) != banner {
+		t.Errorf("HTML without admin gating got %d and banner %q, want 403 and no change", code, bannerHTML.Load())
+	}
+	if code := admin(url.Values{"enable": {"1"}}); code != http.StatusOK || atomic.LoadInt32(&bannerEnabled) != 1 {
+		t.Errorf("enabling without admin gating got %d, want the configured banner on", code)
+	}
+
+	page := []byte("<html><body class=x><p>top</p><!-- omnisci-banner --><p>rest</p></body></html>")
+	if got := string(insertBanner(page, banner)); got != "<html><body class=x><p>top</p><!-- omnisci-banner -->"+banner+"<p>rest</p></body></html>" {
+		t.Errorf("banner not inserted at the marker: %q", got)
+	}
+}
+
+func TestSessionCookieMaxAge(t *testing.T) {
+	keys := [][]byte{bytes.Repeat([]byte("k"), 64), bytes.Repeat([]byte("e"), 32)}
+	for maxAge, want := range map[time.Duration]string{
+		time.Hour:        "Max-Age=3600",
+		90 * time.Minute: "Max-Age=5400",
+		0:                "",
+	} {
+		setGlobal(t, &sessionStore, newSessionStore(keys[0], keys[1], maxAge))
+		r := httptest.NewRequest("POST", "/", strings.NewReader("database=omnisci"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		if err := saveServersJSONParams(rw, r); err != nil {
+			t.Fatal(err)
+		}
+		cookie := rw.Header().Get("Set-Cookie")
+		if want == "" {
+			if strings.Contains(cookie, "Max-Age") || strings.Contains(cookie, "Expires") {
+				t.Errorf("max age 0 set %q, want a browser session cookie", cookie)
+			}
+		} else if !strings.Contains(cookie, want) || !strings.Contains(cookie, "Expires=") {
+			t.Errorf("max age %v set %q, want %s and Expires", maxAge, cookie, want)
+		}
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	metrics "github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// setGlobal sets one of the server's globals for the rest of the test.
+func setGlobal[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// mockCall is a Thrift call received by a mockBackend.
+type mockCall struct {
+	Method string
+	Path   string
+	Body   string
+	Header http.Header
+}
+
+// mockBackend is an httptest.Server standing in for omnisci_server. It answers
+// Thrift JSON calls with a canned response per method, and records the calls
+// it receives.
+type mockBackend struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	calls     []mockCall
+	responses map[string]string
+	failures  map[string][]int
+}
+
+// mockSessionID is the session the mock backend hands out on connect.
+const mockSessionID = "mock-session-5h6KW9NTv1ef1kOfOlAG"
+
+// sqlExecuteResponse is a Thrift JSON reply to sql_execute that reports the
+// given execution and total times, in milliseconds.
+func sqlExecuteResponse(execMs, totalMs int) string {
+	return `[1,"sql_execute",2,0,{"0":{"rec":{"1":{"rec":{"1":{"lst":["rec",0]}}},"2":{"i64":` +
+		strconv.Itoa(execMs) + `},"3":{"i64":` + strconv.Itoa(totalMs) + `},"4":{"str":""}}}}]`
+}
+
+// newMockBackend starts a mock backend, which is shut down with the test, and
+// points the server at it.
+func newMockBackend(t *testing.T) *mockBackend {
+	t.Helper()
+	mb := &mockBackend{
+		responses: map[string]string{
+			"connect":           `[1,"connect",2,0,{"0":{"str":"` + mockSessionID + `"}}]`,
+			"disconnect":        `[1,"disconnect",2,0,{}]`,
+			"sql_execute":       sqlExecuteResponse(12, 34),
+			"get_server_status": `[1,"get_server_status",2,0,{"0":{"rec":{"1":{"tf":0},"2":{"str":"5.0.0"},"5":{"str":"ce"}}}}]`,
+		},
+		failures: make(map[string][]int),
+	}
+	mb.Server = httptest.NewServer(http.HandlerFunc(mb.serve))
+	t.Cleanup(mb.Close)
+
+	u, _ := url.Parse(mb.URL)
+	setGlobal(t, &backendURL, u)
+	return mb
+}
+
+func (mb *mockBackend) serve(rw http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	var msg []json.RawMessage
+	var method string
+	if json.Unmarshal(body, &msg) == nil && len(msg) > 1 {
+		json.Unmarshal(msg[1], &method)
+	}
+
+	mb.mu.Lock()
+	mb.calls = append(mb.calls, mockCall{method, r.URL.RequestURI(), string(body), r.Header.Clone()})
+	resp, ok := mb.responses[method]
+	var status int
+	if f := mb.failures[method]; len(f) > 0 {
+		status, mb.failures[method] = f[0], f[1:]
+	}
+	mb.mu.Unlock()
+
+	if status != 0 {
+		http.Error(rw, http.StatusText(status), status)
+		return
+	}
+	if !ok {
+		resp = `[1,"` + method + `",3,0,{"1":{"str":"Invalid method name: '` + method + `'"},"2":{"i32":1}}]`
+	}
+	rw.Header().Set("Content-Type", "application/vnd.apache.thrift.json")
+	rw.Write([]byte(resp))
+}
+
+// respond sets the response to calls of method.
+func (mb *mockBackend) respond(method, response string) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.responses[method] = response
+}
+
+// fail makes the next calls of method fail with the given HTTP statuses, one
+// per call, before answering normally again.
+func (mb *mockBackend) fail(method string, statuses ...int) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.failures[method] = append(mb.failures[method], statuses...)
+}
+
+// callsOf returns the calls of method received so far.
+func (mb *mockBackend) callsOf(method string) []mockCall {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	var out []mockCall
+	for _, c := range mb.calls {
+		if c.Method == method {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// thriftCall is a Thrift JSON call of method with session as its first
+// argument.
+func thriftCall(method, session string) string {
+	return `[1,"` + method + `",1,0,{"1":{"str":"` + session + `"},"2":{"str":"SELECT 1"}}]`
+}
+
+// newThriftRequest returns a Thrift JSON POST to / carrying body.
+func newThriftRequest(body string) *http.Request {
+	r := httptest.NewRequest("POST", "/", bytes.NewBufferString(body))
+	r.Header.Set("Content-Type", "application/vnd.apache.thrift.json")
+	return r
+}
+
+// newFrontendFixture lays out a frontend directory with an index.html, a beta
+// frontend, a servers.json and a version.txt, and serves it for the rest of
+// the test. It returns the directory.
+func newFrontendFixture(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.html":      "<html><head></head><body><div id=app></div></body></html>",
+		"beta/index.html": "<html><body>beta</body></html>",
+		"app.js":          "console.log('immerse')",
+		"servers.json":    `[{"host":"localhost","port":6273,"database":"omnisci","master":true}]`,
+		"version.txt":     "5.0.0-immerse\n",
+	}
+	for name, content := range files {
+		writeTestFile(t, filepath.Join(dir, name), content)
+	}
+	setGlobal(t, &frontend, dir)
+	setGlobal(t, &frontendFS, http.FileSystem(overlayFileSystem{http.Dir(dir)}))
+	setGlobal(t, &versionLoaded, false)
+	return dir
+}
+
+// writeTestFile writes content to path, creating its directory as needed.
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newSessionStoreFixture replaces the servers.json session store with one
+// using fixed keys for the rest of the test.
+func newSessionStoreFixture(t *testing.T) *sessions.CookieStore {
+	t.Helper()
+	store := newSessionStore(bytes.Repeat([]byte("k"), 64), bytes.Repeat([]byte("e"), 32), 0)
+	setGlobal(t, &sessionStore, store)
+	return store
+}
+
+// samlCookies returns the cookies SAML login sets for sessionID.
+func samlCookies(sessionID string) []*http.Cookie {
+	return []*http.Cookie{
+		{Name: thriftSessionCookieName, Value: sessionID},
+		{Name: samlAuthCookieName, Value: "true"},
+		{Name: samlSignatureCookieName, Value: samlSignature(sessionID)},
+	}
+}
+
+// useMetrics turns on metrics, recorded in a fresh registry, for the rest of
+// the test. Backend timings and health probes still being recorded are waited
+// for before the registry is restored.
+func useMetrics(t *testing.T) {
+	t.Helper()
+	setGlobal(t, &enableMetrics, true)
+	setGlobal(t, &registry, metrics.NewRegistry())
+	t.Cleanup(func() {
+		pendingTimings.Wait()
+		healthProbes.Wait()
+	})
+}
+
+// waitForTimer waits for the backend timings, which are recorded in the
+// background, and returns the timer name.
+func waitForTimer(t *testing.T, name string) metrics.Timer {
+	t.Helper()
+	pendingTimings.Wait()
+	m, ok := registry.Get(name).(metrics.Timer)
+	if !ok || m.Count() == 0 {
+		t.Fatalf("timer %s was not recorded", name)
+	}
+	return m
+}
+
+// multipartBody encodes files, by name, and fields as a multipart form. It
+// returns the body and its content type.
+func multipartBody(t *testing.T, files map[string]string, fields map[string]string) (*bytes.Buffer, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, value := range fields {
+		mw.WriteField(name, value)
+	}
+	for name, content := range files {
+		fw, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	mw.Close()
+	return &buf, mw.FormDataContentType()
+}
+
+// newUploadFixture points the server's data directory at a fresh one for the
+// rest of the test, and returns the directory uploads of sessionID go to.
+func newUploadFixture(t *testing.T, sessionID string) string {
+	t.Helper()
+	setGlobal(t, &dataDir, t.TempDir())
+	sum := sha256.Sum256([]byte(sessionID))
+	return filepath.Join(dataDir, "mapd_import", hex.EncodeToString(sum[:]))
+}
+
+// resumableRequest sends a request of the upload-session session for the
+// resumable upload at path, with the given header name and value pairs.
+func resumableRequest(t *testing.T, method, path, body string, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("sessionid", "upload-session")
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	rw := httptest.NewRecorder()
+	resumableUploadHandler(rw, r)
+	return rw
+}
+
+// testCA is a certificate authority issuing certificates for TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	PEM  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate for name, for use by a server on localhost or
+// by a client.
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// pool returns a pool holding only the CA's certificate.
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// newTLSServer starts a server for h with the TLS configuration cfg, which is
+// shut down with the test.
+func newTLSServer(t *testing.T, h http.Handler, cfg *tls.Config) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(h)
+	srv.TLS = cfg
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// tlsClient returns a client trusting ca, which presents certs if any.
+func tlsClient(ca *testCA, certs ...tls.Certificate) *http.Client {
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      ca.pool(),
+		Certificates: certs,
+	}}}
+}
+
+// discardResponseWriter is an http.ResponseWriter that throws the response
+// away, or fails writes after failAfter bytes when that is set.
+type discardResponseWriter struct {
+	header    http.Header
+	status    int
+	written   int
+	failAfter int
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *discardResponseWriter) WriteHeader(c int) {
+	if w.status == 0 {
+		w.status = c
+	}
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.failAfter > 0 && w.written+len(b) > w.failAfter {
+		n := w.failAfter - w.written
+		w.written += n
+		return n, errors.New("client went away")
+	}
+	w.written += len(b)
+	return len(b), nil
+}
+
+// captureLog collects what the server logs for the rest of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(ioutil.Discard) })
+	return &buf
+}
+
+// fatalExit is what log.Fatal panics with under exitsFatally.
+type fatalExit struct{}
+
+// exitsFatally reports whether f logs a fatal error, which would exit the
+// server.
+func exitsFatally(t *testing.T, f func()) (fatal bool) {
+	t.Helper()
+	logger := log.StandardLogger()
+	exit := logger.ExitFunc
+	logger.ExitFunc = func(int) { panic(fatalExit{}) }
+	defer func() {
+		logger.ExitFunc = exit
+		if r := recover(); r != nil {
+			if _, ok := r.(fatalExit); !ok {
+				panic(r)
+			}
+			fatal = true
+		}
+	}()
+	f()
+	return false
+}